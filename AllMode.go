@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"sync"
+	"time"
+)
+
+// AllMode runs scrape intake, processing, periodic cleanup and the server in one process, for small deployments and local development.
+// On shutdown it waits for the server to drain, for process mode to finish or requeue its batch, and for a running cleanup to finish.
+// Failed cleanups are only logged, the next one repairs what they left.
+func AllMode(ctx context.Context, imageDir string, processOptions ProcessOptions, shutdownTimeout time.Duration, jitter time.Duration, workers int, lane string, cleanupInterval time.Duration) {
+	log.Info("All-in-one mode launching, cleaning up every ", cleanupInterval)
+
+	// queries piped into stdin are scraped once, the tag subscriptions keep running afterwards
+	if stdinIsPiped() {
+		go ScrapeMode(workers, lane)
+	}
+	go SchedulerMode(ctx, jitter, workers)
+
+	var processWg sync.WaitGroup
+	processWg.Add(1)
+	go func() {
+		defer processWg.Done()
+		ProcessMode(ctx, imageDir, processOptions)
+	}()
+
+	var cleanupWg sync.WaitGroup
+	cleanupWg.Add(1)
+	go func() {
+		defer cleanupWg.Done()
+		ticker := time.NewTicker(cleanupInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				err := CleanupMode(imageDir)
+				if err != nil {
+					log.Error("Cleanup failed: ", err)
+				}
+			}
+		}
+	}()
+
+	ServerMode(ctx, imageDir, shutdownTimeout)
+	processWg.Wait()
+	cleanupWg.Wait()
+}
+
+func stdinIsPiped() bool {
+	stat, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+	return stat.Mode()&os.ModeCharDevice == 0
+}
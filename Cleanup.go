@@ -3,32 +3,30 @@ package main
 import (
 	"Paktum/Database"
 	"Paktum/ImageScraper"
-	"bytes"
-	"context"
-	"encoding/gob"
-	"github.com/corona10/goimagehash"
+	"errors"
+	"fmt"
 	"github.com/meilisearch/meilisearch-go"
 	log "github.com/sirupsen/logrus"
 	"os"
+	"path/filepath"
 	"time"
 )
 
-func RemoveImagesWithBadTags(imageDir string) {
+func RemoveImagesWithBadTags(imageDir string) error {
 	var allDocuments []map[string]interface{}
 
 	// get all documents from meilisearch
 	for offset := 0; ; offset += 1000 {
 		var docs meilisearch.DocumentsResult
 		err := Database.GetMeiliClient().Index("images").GetDocuments(&meilisearch.DocumentsQuery{
-			Fields: []string{"ID", "Tags", "Filename"},
+			Fields: []string{"ID", "Tags", "Filename", "Poster"},
 			Limit:  1000,
 			Offset: int64(offset),
 		}, &docs)
 		log.Info("Got ", len(docs.Results), " documents from meilisearch, offset ", offset)
 
 		if err != nil {
-			log.Fatal("Failed to get documents from MeiliSearch:", err)
-			return
+			return fmt.Errorf("failed to get documents from MeiliSearch: %w", err)
 		}
 		if len(docs.Results) == 0 {
 			break
@@ -45,10 +43,16 @@ func RemoveImagesWithBadTags(imageDir string) {
 		for _, tag := range doc["Tags"].([]interface{}) {
 			if ImageScraper.TagIsBanned(tag.(string)) {
 				log.Info("Removing image ", id, " because it has a banned tag ", tag)
-				err := os.Remove(doc["Filename"].(string))
+				err := os.Remove(filepath.Join(imageDir, doc["Filename"].(string)))
 				if err != nil {
 					log.Error("Failed to remove image from filesystem ", id, " ", doc["Filename"].(string), ": ", err)
 				}
+				if poster, _ := doc["Poster"].(string); poster != "" {
+					err = os.Remove(filepath.Join(imageDir, poster))
+					if err != nil {
+						log.Error("Failed to remove poster from filesystem ", id, " ", poster, ": ", err)
+					}
+				}
 
 				toDelete = append(toDelete, id)
 			}
@@ -57,38 +61,45 @@ func RemoveImagesWithBadTags(imageDir string) {
 
 	if len(toDelete) == 0 {
 		log.Info("No images to delete")
-		return
+		return nil
 	}
 
 	// delete all images that have been marked for deletion
 	taskInfo, err := Database.GetMeiliClient().Index("images").DeleteDocuments(toDelete)
 	if err != nil {
-		log.Fatal("Failed to delete documents from MeiliSearch:", err)
-		return
+		return fmt.Errorf("failed to delete documents from MeiliSearch: %w", err)
 	}
 
-	if Database.WaitForMeilisearchTask(taskInfo) {
-		log.Info("Successfully removed ", len(toDelete), " images with banned tags")
-	} else {
-		log.Error("Failed to remove images with banned tags")
+	if !Database.WaitForMeilisearchTask(taskInfo) {
+		return errors.New("failed to remove images with banned tags")
 	}
+	log.Info("Successfully removed ", len(toDelete), " images with banned tags")
+	return nil
 }
 
-func GenerateRelatedGroups() {
+// GenerateRelatedGroups rebuilds all variant groups from scratch.
+// Process mode attaches new images to the groups as they are indexed, so this only has to repair them, e.g. after images were removed.
+func GenerateRelatedGroups() error {
+	// images process mode indexes from here on may be missing from the documents, they are picked up from the pHash index
+	position, err := Database.GetPHashIndexPosition()
+	if err != nil {
+		return err
+	}
+
 	var allDocuments []map[string]interface{}
 
 	// get all documents from meilisearch
 	for offset := 0; ; offset += 1000 {
 		var docs meilisearch.DocumentsResult
 		err := Database.GetMeiliClient().Index("images").GetDocuments(&meilisearch.DocumentsQuery{
-			Fields: []string{"ID", "PHash"},
+			Fields: []string{"ID", "PHash", "Width", "Height", "Size", "GroupID", "GroupBest"},
 			Limit:  1000,
 			Offset: int64(offset),
 		}, &docs)
 		log.Info("Got ", len(docs.Results), " documents from meilisearch, offset ", offset)
 
 		if err != nil {
-			log.Fatal("Failed to get documents from MeiliSearch:", err)
+			return fmt.Errorf("failed to get documents from MeiliSearch: %w", err)
 		}
 		if len(docs.Results) == 0 {
 			break
@@ -101,149 +112,90 @@ func GenerateRelatedGroups() {
 
 	startTime := time.Now()
 
-	duplicates := make(map[string][]Database.PHashEntry)
-
-	// find duplicates using pHash
-	for i, doc := range allDocuments {
-		needleHash, _ := doc["PHash"].(float64)
-		needleID, _ := doc["ID"].(string)
-
-		if uint64(needleHash) == 0 {
-			continue
-		}
-
-		log.Trace("Processing document ", i, " with ID ", needleID, " and pHash ", needleHash)
-
-		hash := goimagehash.NewImageHash(uint64(needleHash), goimagehash.PHash)
-
-		for j := i + 1; j < len(allDocuments); j++ {
-			otherHash, _ := allDocuments[j]["PHash"].(float64)
-			otherID, _ := allDocuments[j]["ID"].(string)
-
-			if uint64(otherHash) == 0 {
-				continue
-			}
-
-			otherImgHash := goimagehash.NewImageHash(uint64(otherHash), goimagehash.PHash)
-
-			distance, err := hash.Distance(otherImgHash)
-			if err != nil {
-				log.Error("Failed to get distance between hashes: ", err)
-				continue
-			}
-
-			if distance < 10 {
-				log.Info("Found possible image variant with IDs ", needleID, " and ", otherID, " with distance ", distance)
-				duplicates[needleID] = append(duplicates[needleID], Database.PHashEntry{
-					ID:       otherID,
-					Hash:     uint64(otherHash),
-					Distance: distance,
-				})
-			}
+	candidates := make([]Database.VariantCandidate, 0, len(allDocuments))
+	previousGroupIDs := make(map[string]string)
+	for _, doc := range allDocuments {
+		id, _ := doc["ID"].(string)
+		if groupID, _ := doc["GroupID"].(string); groupID != "" && groupID != id {
+			previousGroupIDs[id] = groupID
 		}
+		hash, _ := Database.ParseStoredPHash(doc["PHash"])
+		width, _ := doc["Width"].(float64)
+		height, _ := doc["Height"].(float64)
+		size, _ := doc["Size"].(float64)
+
+		candidates = append(candidates, Database.VariantCandidate{
+			ID:     id,
+			Hash:   hash,
+			Width:  int(width),
+			Height: int(height),
+			Size:   int(size),
+		})
 	}
 
-	var duplicateGroups [][]Database.PHashEntry
-
-	// detect duplicate groups and add them to a nested array to have a simplified way to create graphs
-	for originalKey, original := range duplicates {
-		// check whether the key of this group exists in the groups array
-		// if not, we create a new group and throw all sub-keys into it along with the main key
-		// if it does, we add all sub-keys to the group, including the main key
-
-		// find the index of the group where the original key is a member
-		// if it is not a member of any group, it returns -1
-		groupIndex := FindInside([]Database.PHashEntry{FindPHashFromID(originalKey, allDocuments)}, duplicateGroups)
-		if groupIndex == -1 {
-			// create a new group
-			duplicateGroups = append(duplicateGroups, append(original, FindPHashFromID(originalKey, allDocuments)))
-		} else {
-			// add the original key to the group
-			duplicateGroups[groupIndex] = append(duplicateGroups[groupIndex], FindPHashFromID(originalKey, allDocuments))
-
-			// add all sub-keys to the groups
-			duplicateGroups[groupIndex] = MergeGroups(duplicateGroups[groupIndex], original)
-		}
+	// find variants using pHash and group everything that is connected by them, the groups keep their IDs.
+	// The groups are stored along with the index process mode matches new images against
+	duplicateGroups, err := Database.RebuildVariantGroups(candidates, position, previousGroupIDs, Database.GetVariantMaxDistance())
+	if err != nil {
+		return err
 	}
 
 	log.Info("Found ", len(duplicateGroups), " duplicate groups")
-	for i, group := range duplicateGroups {
-		log.Trace("Group ", i, " contains ", len(group), " members")
-		for _, member := range group {
+	for _, group := range duplicateGroups {
+		log.Trace("Group ", group.ID, " contains ", len(group.Members), " members, best is ", group.Best)
+		for _, member := range group.Members {
 			log.Trace("Member ", member)
 		}
 	}
 
 	log.Info("Finished in ", time.Since(startTime))
+	log.Info("Stored alt groups and pHash index in redis successfully")
 
-	// encode duplicateGroups with gob and store it in redis
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(duplicateGroups)
-	if err != nil {
-		log.Error(err)
-		return
-	}
-
-	err = Database.GetRedis().Set(context.Background(), "paktum:image_alts", buf.Bytes(), 0).Err()
-	if err != nil {
-		log.Error(err)
-		return
-	}
-	log.Info("Stored alt groups in redis successfully")
-}
-
-func CleanupMode(imageDir string) {
-	RemoveImagesWithBadTags(imageDir)
-	GenerateRelatedGroups()
-}
-
-func PHashExistsInGroup(hash uint64, group []Database.PHashEntry) bool {
-	for _, member := range group {
-		if member.Hash == hash {
-			return true
-		}
+	// only the documents whose group changed are updated, members that were indexed meanwhile aren't among the documents and are always updated.
+	// Images without variants are stored as the best image of their own group
+	currentGroups := make(map[string]Database.ImageGroup, len(allDocuments))
+	for _, doc := range allDocuments {
+		id, _ := doc["ID"].(string)
+		groupID, _ := doc["GroupID"].(string)
+		best, _ := doc["GroupBest"].(bool)
+		currentGroups[id] = Database.ImageGroup{ID: groupID, Best: best}
 	}
-
-	return false
-}
-
-func FindInside(haystack []Database.PHashEntry, groups [][]Database.PHashEntry) int {
-	// goes through all groups and detects group where any in haystack is a member, if one is found, it returns the index of the group
-	// if none is found, it returns -1
-	for i, group := range groups {
-		for _, member := range group {
-			for _, needle := range haystack {
-				if member.Hash == needle.Hash {
-					return i
-				}
+	grouped := make(map[string]bool)
+	changedGroups := make(map[string]Database.ImageGroup)
+	for _, group := range duplicateGroups {
+		for _, member := range group.Members {
+			grouped[member.ID] = true
+			memberGroup := Database.ImageGroup{ID: group.ID, Best: member.ID == group.Best}
+			if currentGroup, ok := currentGroups[member.ID]; !ok || currentGroup != memberGroup {
+				changedGroups[member.ID] = memberGroup
 			}
 		}
 	}
-
-	return -1
-}
-
-func MergeGroups(originalGroup []Database.PHashEntry, newGroup []Database.PHashEntry) []Database.PHashEntry {
-	for _, member := range newGroup {
-		if !PHashExistsInGroup(member.Hash, originalGroup) {
-			originalGroup = append(originalGroup, member)
+	for id, currentGroup := range currentGroups {
+		if !grouped[id] && currentGroup != (Database.ImageGroup{ID: id, Best: true}) {
+			changedGroups[id] = Database.ImageGroup{}
 		}
 	}
 
-	return originalGroup
+	err = Database.UpdateImageGroups(changedGroups)
+	if err != nil {
+		return err
+	}
+	log.Info("Updated the group of ", len(changedGroups), " images")
+	return nil
 }
 
-func FindPHashFromID(id string, docs []map[string]interface{}) Database.PHashEntry {
-	for _, doc := range docs {
-		if doc["ID"] == id {
-			return Database.PHashEntry{
-				ID:       id,
-				Hash:     uint64(doc["PHash"].(float64)),
-				Distance: 0,
-			}
-		}
+// CleanupMode removes images with banned tags and rebuilds the variant groups.
+// The groups are rebuilt even if removing images failed, the first error is returned.
+func CleanupMode(imageDir string) error {
+	removeErr := RemoveImagesWithBadTags(imageDir)
+	if removeErr != nil {
+		log.Error("Failed to remove images with banned tags: ", removeErr)
 	}
 
-	return Database.PHashEntry{}
+	err := GenerateRelatedGroups()
+	if removeErr != nil {
+		return removeErr
+	}
+	return err
 }
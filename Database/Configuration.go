@@ -2,6 +2,7 @@ package Database
 
 import (
 	"encoding/hex"
+	"fmt"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -69,3 +70,23 @@ func GetBaseURL() string {
 
 	return baseURL
 }
+
+// MaxVariantDistance is the largest supported Hamming distance between similar images.
+// Larger distances mostly match unrelated images and make lookups in the pHash index slow.
+const MaxVariantDistance = 16
+
+// variantMaxDistance is the largest Hamming distance between the pHashes of two images that are considered variants
+var variantMaxDistance = 9
+
+func SetVariantMaxDistance(distance int) error {
+	if distance < 0 || distance > MaxVariantDistance {
+		return fmt.Errorf("variant distance must be between 0 and %d, got %d", MaxVariantDistance, distance)
+	}
+
+	variantMaxDistance = distance
+	return nil
+}
+
+func GetVariantMaxDistance() int {
+	return variantMaxDistance
+}
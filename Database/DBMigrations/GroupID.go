@@ -0,0 +1,29 @@
+package DBMigrations
+
+import (
+	"Paktum/Database"
+	log "github.com/sirupsen/logrus"
+	"os"
+)
+
+// Makes the variant group of images filterable, so related images can be looked up by it and searches can be collapsed to the best image of every group.
+// Existing images get their group on the next run of cleanup mode, until then they aren't collapsed.
+func init() {
+	Database.RegisterMigration(Database.Migration{
+		Version: 2,
+		Handler: func() {
+			imageCollection := Database.GetMeiliClient().Index("images")
+			taskid, err := imageCollection.UpdateFilterableAttributes(&[]string{"ID", "Tagstring", "Rating", "Tags", "Filename", "GroupID", "GroupBest"})
+			if err != nil {
+				log.Error("Migration failed: Failed to update filterable attributes:", err)
+				os.Exit(1)
+				return
+			}
+			if !Database.WaitForMeilisearchTask(taskid) {
+				log.Error("Migration failed: Failed to update filterable attributes")
+				os.Exit(1)
+				return
+			}
+		},
+	})
+}
@@ -0,0 +1,89 @@
+package DBMigrations
+
+import (
+	"Paktum/Database"
+	"github.com/meilisearch/meilisearch-go"
+	log "github.com/sirupsen/logrus"
+	"os"
+)
+
+// Stores the pHash of existing images as a decimal string, like new images are indexed.
+// Search hits are decoded into float64, which loses the lowest bits of most pHashes.
+// The exact value is read document by document, since only then the number is decoded into a StoredPHash.
+func init() {
+	Database.RegisterMigration(Database.Migration{
+		Version: 3,
+		Handler: func() {
+			imageCollection := Database.GetMeiliClient().Index("images")
+
+			var numericIDs []string
+			for offset := 0; ; offset += 1000 {
+				var docs meilisearch.DocumentsResult
+				err := imageCollection.GetDocuments(&meilisearch.DocumentsQuery{
+					Fields: []string{"ID", "PHash"},
+					Limit:  1000,
+					Offset: int64(offset),
+				}, &docs)
+				if err != nil {
+					log.Error("Migration failed: Failed to get documents:", err)
+					os.Exit(1)
+					return
+				}
+				if len(docs.Results) == 0 {
+					break
+				}
+
+				for _, doc := range docs.Results {
+					if _, ok := doc["PHash"].(float64); ok {
+						id, _ := doc["ID"].(string)
+						numericIDs = append(numericIDs, id)
+					}
+				}
+			}
+			log.Info("Converting the pHash of ", len(numericIDs), " images to strings")
+
+			updates := make([]map[string]interface{}, 0, 1000)
+			flush := func() {
+				if len(updates) == 0 {
+					return
+				}
+				taskid, err := imageCollection.UpdateDocuments(&updates)
+				if err != nil {
+					log.Error("Migration failed: Failed to update pHashes:", err)
+					os.Exit(1)
+					return
+				}
+				if !Database.WaitForMeilisearchTask(taskid) {
+					log.Error("Migration failed: Failed to update pHashes")
+					os.Exit(1)
+					return
+				}
+				updates = make([]map[string]interface{}, 0, 1000)
+			}
+
+			for i, id := range numericIDs {
+				var doc struct {
+					PHash Database.StoredPHash `json:"PHash"`
+				}
+				err := imageCollection.GetDocument(id, &meilisearch.DocumentQuery{
+					Fields: []string{"PHash"},
+				}, &doc)
+				if err != nil {
+					log.Error("Migration failed: Failed to get document ", id, ":", err)
+					os.Exit(1)
+					return
+				}
+
+				updates = append(updates, map[string]interface{}{
+					"ID":    id,
+					"PHash": doc.PHash,
+				})
+				if len(updates) == 1000 {
+					flush()
+					log.Info("Converted the pHash of ", i+1, " of ", len(numericIDs), " images")
+				}
+			}
+			flush()
+		},
+	})
+}
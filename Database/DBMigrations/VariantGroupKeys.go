@@ -0,0 +1,22 @@
+package DBMigrations
+
+import (
+	"Paktum/Database"
+	log "github.com/sirupsen/logrus"
+	"os"
+)
+
+// Moves the variant groups out of the single redis key older builds stored all of them in, into one hash entry per group.
+func init() {
+	Database.RegisterMigration(Database.Migration{
+		Version: 4,
+		Handler: func() {
+			err := Database.ConvertLegacyVariantGroups()
+			if err != nil {
+				log.Error("Migration failed: Failed to convert variant groups:", err)
+				os.Exit(1)
+				return
+			}
+		},
+	})
+}
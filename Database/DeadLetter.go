@@ -0,0 +1,237 @@
+package Database
+
+import (
+	"Paktum/ImageScraper"
+	"Paktum/graph/model"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// DeadLetter is an image that process mode failed to index
+type DeadLetter struct {
+	ID       string             `json:"id"`
+	Image    ImageScraper.Image `json:"image"`
+	Reason   string             `json:"reason"`
+	Attempts int                `json:"attempts"`
+	// Timestamp is the UNIX timestamp of the last failure
+	Timestamp int64 `json:"timestamp"`
+}
+
+// deadLetterKey is a hash of dead letter ID to JSON-encoded DeadLetter, so an image that keeps failing only has one entry
+const deadLetterKey = "paktum:dead_letter"
+
+// imageAttemptsKey is a hash of dead letter ID to the number of failed attempts, it outlives retries of the dead letter
+const imageAttemptsKey = "paktum:image_attempts"
+
+// batchAttemptsKey is a hash of the SHA-1 of a batch payload to the number of times meili failed to index the batch
+const batchAttemptsKey = "paktum:batch_attempts"
+
+// DeadLetterID identifies an image across attempts by its source and post ID
+func DeadLetterID(image ImageScraper.Image) string {
+	return image.Source + ":" + image.ID
+}
+
+/* AddDeadLetter records a failed image along with the reason and its number of attempts so far
+ * @param image The image that failed
+ * @param reason Why it failed
+ */
+func AddDeadLetter(image ImageScraper.Image, reason string) error {
+	id := DeadLetterID(image)
+
+	attempts, err := GetRedis().HIncrBy(context.Background(), imageAttemptsKey, id, 1).Result()
+	if err != nil {
+		return err
+	}
+
+	entry, err := json.Marshal(DeadLetter{
+		ID:        id,
+		Image:     image,
+		Reason:    reason,
+		Attempts:  int(attempts),
+		Timestamp: time.Now().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	return GetRedis().HSet(context.Background(), deadLetterKey, id, entry).Err()
+}
+
+/* ClearImageAttempts forgets the failed attempts of images that have been indexed successfully
+ * @param images The indexed images
+ */
+func ClearImageAttempts(images []ImageScraper.Image) error {
+	if len(images) == 0 {
+		return nil
+	}
+
+	ids := make([]string, 0, len(images))
+	for _, image := range images {
+		ids = append(ids, DeadLetterID(image))
+	}
+
+	return GetRedis().HDel(context.Background(), imageAttemptsKey, ids...).Err()
+}
+
+func batchAttemptsID(payload string) string {
+	sum := sha1.Sum([]byte(payload))
+	return hex.EncodeToString(sum[:])
+}
+
+/* AddBatchAttempt records that a batch failed to be indexed
+ * @param payload The payload of the batch as it was claimed from the queue
+ * @return The number of failed attempts of the batch so far, and a possible error
+ */
+func AddBatchAttempt(payload string) (int, error) {
+	attempts, err := GetRedis().HIncrBy(context.Background(), batchAttemptsKey, batchAttemptsID(payload), 1).Result()
+	return int(attempts), err
+}
+
+/* ClearBatchAttempts forgets the failed attempts of a batch once it was indexed or given up on
+ * @param payload The payload of the batch as it was claimed from the queue
+ */
+func ClearBatchAttempts(payload string) error {
+	return GetRedis().HDel(context.Background(), batchAttemptsKey, batchAttemptsID(payload)).Err()
+}
+
+/* GetDeadLetters returns all dead letters, most recent failure first
+ * @return A list of dead letters and a possible error
+ */
+func GetDeadLetters() ([]DeadLetter, error) {
+	entries, err := GetRedis().HGetAll(context.Background(), deadLetterKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	deadLetters := make([]DeadLetter, 0, len(entries))
+	for _, entry := range entries {
+		var deadLetter DeadLetter
+		err := json.Unmarshal([]byte(entry), &deadLetter)
+		if err != nil {
+			return nil, err
+		}
+		deadLetters = append(deadLetters, deadLetter)
+	}
+
+	sort.Slice(deadLetters, func(i, j int) bool {
+		return deadLetters[i].Timestamp > deadLetters[j].Timestamp
+	})
+
+	return deadLetters, nil
+}
+
+// getDeadLettersByID returns the dead letters with the given IDs, or all of them if ids is empty
+func getDeadLettersByID(ids []string) ([]DeadLetter, error) {
+	deadLetters, err := GetDeadLetters()
+	if err != nil || len(ids) == 0 {
+		return deadLetters, err
+	}
+
+	wanted := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+
+	var selected []DeadLetter
+	for _, deadLetter := range deadLetters {
+		if wanted[deadLetter.ID] {
+			selected = append(selected, deadLetter)
+		}
+	}
+	return selected, nil
+}
+
+/* RetryDeadLetters sends dead letters back to process mode and removes them from the dead letter queue
+ * Their attempt count is kept, so it keeps growing if they fail again
+ * Selected dead letters are retried in the interactive lane, retrying all of them goes into the backfill lane
+ * @param ids The IDs of the dead letters to retry, all are retried if empty
+ * @return The number of retried dead letters and a possible error
+ */
+func RetryDeadLetters(ids []string) (int, error) {
+	deadLetters, err := getDeadLettersByID(ids)
+	if err != nil {
+		return 0, err
+	}
+
+	lane := LaneBackfill
+	if len(ids) > 0 {
+		lane = LaneInteractive
+	}
+
+	batchSize := 100
+	retried := 0
+	for i := 0; i < len(deadLetters); i += batchSize {
+		end := i + batchSize
+		if end > len(deadLetters) {
+			end = len(deadLetters)
+		}
+
+		images := make([]ImageScraper.Image, 0, end-i)
+		retriedIDs := make([]string, 0, end-i)
+		for _, deadLetter := range deadLetters[i:end] {
+			images = append(images, deadLetter.Image)
+			retriedIDs = append(retriedIDs, deadLetter.ID)
+		}
+
+		payload, err := EncodeImageBatch(images)
+		if err != nil {
+			return retried, err
+		}
+		err = GetWorkQueue().Push(LaneQueue(lane), string(payload))
+		if err != nil {
+			return retried, err
+		}
+		err = GetRedis().HDel(context.Background(), deadLetterKey, retriedIDs...).Err()
+		if err != nil {
+			return retried, err
+		}
+		retried += len(retriedIDs)
+	}
+
+	return retried, nil
+}
+
+/* PurgeDeadLetters deletes dead letters along with their attempt count
+ * @param ids The IDs of the dead letters to purge, all are purged if empty
+ * @return The number of purged dead letters and a possible error
+ */
+func PurgeDeadLetters(ids []string) (int, error) {
+	deadLetters, err := getDeadLettersByID(ids)
+	if err != nil || len(deadLetters) == 0 {
+		return 0, err
+	}
+
+	purgedIDs := make([]string, 0, len(deadLetters))
+	for _, deadLetter := range deadLetters {
+		purgedIDs = append(purgedIDs, deadLetter.ID)
+	}
+
+	err = GetRedis().HDel(context.Background(), deadLetterKey, purgedIDs...).Err()
+	if err != nil {
+		return 0, err
+	}
+	err = GetRedis().HDel(context.Background(), imageAttemptsKey, purgedIDs...).Err()
+	if err != nil {
+		return 0, err
+	}
+
+	return len(purgedIDs), nil
+}
+
+func DBDeadLetterToGraphDeadLetter(deadLetter DeadLetter) *model.DeadLetter {
+	return &model.DeadLetter{
+		ID:           deadLetter.ID,
+		Reason:       deadLetter.Reason,
+		Attempts:     deadLetter.Attempts,
+		Timestamp:    strconv.FormatInt(deadLetter.Timestamp, 10),
+		SourceName:   deadLetter.Image.Source,
+		SourcePostID: deadLetter.Image.ID,
+		Filename:     deadLetter.Image.Filename,
+		FileURL:      deadLetter.Image.FileURL,
+	}
+}
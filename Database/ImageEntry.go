@@ -3,36 +3,104 @@ package Database
 import (
 	"Paktum/ImageScraper"
 	"Paktum/graph/model"
-	"bytes"
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
-	"encoding/gob"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/getsentry/sentry-go"
+	"github.com/go-redis/redis/v8"
 	"github.com/meilisearch/meilisearch-go"
 	log "github.com/sirupsen/logrus"
 	"math/rand"
+	"sort"
 	"strconv"
 	"strings"
-	"time"
+	"sync"
 )
 
 type ImageEntry struct {
-	ID           string   `json:"ID"`
-	URL          string   `json:"URL"`
-	ThumbnailURL string   `json:"ThumbnailURL"`
-	Tags         []string `json:"Tags"`
-	Tagstring    string   `json:"Tagstring"`
-	Rating       Rating   `json:"Rating"`
-	Added        string   `json:"Added"`
-	PHash        uint64   `json:"PHash"`
-	Size         int      `json:"Size"`
-	Width        int      `json:"Width"`
-	Height       int      `json:"Height"`
-	Filename     string   `json:"Filename"`
+	ID           string      `json:"ID"`
+	URL          string      `json:"URL"`
+	ThumbnailURL string      `json:"ThumbnailURL"`
+	Tags         []string    `json:"Tags"`
+	Tagstring    string      `json:"Tagstring"`
+	Rating       Rating      `json:"Rating"`
+	Added        string      `json:"Added"`
+	PHash        StoredPHash `json:"PHash"`
+	Size         int         `json:"Size"`
+	Width        int         `json:"Width"`
+	Height       int         `json:"Height"`
+	Filename     string      `json:"Filename"`
+	// MimeType is detected from the content of the file, empty for images indexed before it was stored
+	MimeType string `json:"MimeType"`
+	// Video metadata read by ffprobe, zero for images
+	Duration   float64 `json:"Duration"`
+	VideoCodec string  `json:"VideoCodec"`
+	HasAudio   bool    `json:"HasAudio"`
+	// Poster is the filename of the JPEG frame shown as thumbnail of a video
+	Poster string `json:"Poster"`
+	// Metadata of the post the image was scraped from, empty for imported images
+	SourceName    string `json:"SourceName"`
+	SourcePostID  string `json:"SourcePostID"`
+	SourceURL     string `json:"SourceURL"`
+	ArtworkSource string `json:"ArtworkSource"`
+	Score         int    `json:"Score"`
+	Uploaded      string `json:"Uploaded"`
+	ParentID      string `json:"ParentID"`
+	// GroupID is the ID of the variant group of the image, the ID of the image itself if it has no variants
+	GroupID string `json:"GroupID"`
+	// GroupBest is whether the image is the best one of its variant group, or has no variants.
+	// Collapsed searches only return these, images indexed before it was stored don't have it and are never collapsed
+	GroupBest bool `json:"GroupBest"`
+}
+
+// StoredPHash is a pHash as it is stored on image documents.
+// It is written as a decimal string, since meilisearch responses are decoded into float64, which can't hold all 64 bits.
+// Documents indexed before hold it as a number, which is still read exactly as long as it is decoded into a StoredPHash.
+type StoredPHash uint64
+
+func (h StoredPHash) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatUint(uint64(h), 10))
+}
+
+func (h *StoredPHash) UnmarshalJSON(data []byte) error {
+	value := string(data)
+	if value == "null" {
+		*h = 0
+		return nil
+	}
+	if strings.HasPrefix(value, "\"") {
+		err := json.Unmarshal(data, &value)
+		if err != nil {
+			return err
+		}
+	}
+
+	hash, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid pHash %s: %w", value, err)
+	}
+	*h = StoredPHash(hash)
+	return nil
+}
+
+/* ParseStoredPHash reads the pHash of a document that was decoded into a map, like search hits
+ * @param value The PHash field of the document
+ * @return The pHash, which is only exact if the document already stores it as a string, and if value was a valid pHash
+ */
+func ParseStoredPHash(value interface{}) (uint64, bool) {
+	switch value := value.(type) {
+	case string:
+		hash, err := strconv.ParseUint(value, 10, 64)
+		return hash, err == nil
+	case float64:
+		// documents that migration 3 hasn't converted yet, the lowest bits of their pHash may be lost
+		return uint64(value), true
+	}
+	return 0, false
 }
 
 type Rating string
@@ -44,30 +112,45 @@ const (
 	RatingGeneral      Rating = "general"
 )
 
-var lastPHashFetch uint64
-var phashGroupMap [][]PHashEntry
+var phashGroupMutex sync.Mutex
+var phashGroupVersion string
+var phashGroupMap []VariantGroup
 
 /* GetPHashes returns a list of all phash groups in the database
+ * The groups are cached until process or cleanup mode changes them
  * @return A list of phash groups
  */
-func GetPHashGroups() ([][]PHashEntry, error) {
-	// If the last fetch of this was longer than 5 minutes ago, fetch a fresh copy from the redis db
-	if lastPHashFetch+300 < uint64(time.Now().Unix()) {
-		groupGob, err := GetRedis().Get(context.TODO(), "paktum:image_alts").Result()
+func GetPHashGroups() ([]VariantGroup, error) {
+	phashGroupMutex.Lock()
+	defer phashGroupMutex.Unlock()
+
+	version, err := GetRedis().Get(context.TODO(), variantGroupsVersionKey).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	// Only fetch a fresh copy from the redis db if the groups changed since the last fetch
+	if phashGroupMap == nil || version != phashGroupVersion {
+		groupPayloads, err := GetRedis().HGetAll(context.TODO(), variantGroupsKey).Result()
 		if err != nil {
 			return nil, err
 		}
 
-		var groupMap [][]PHashEntry
-		dec := gob.NewDecoder(bytes.NewBuffer([]byte(groupGob)))
-		err = dec.Decode(&groupMap)
-		if err != nil {
-			log.Error("Failed to decode image gob:", err.Error())
-			return nil, err
+		groupMap := make([]VariantGroup, 0, len(groupPayloads))
+		for _, groupPayload := range groupPayloads {
+			group, err := DecodeVariantGroup([]byte(groupPayload))
+			if err != nil {
+				log.Error("Failed to decode image group:", err.Error())
+				return nil, err
+			}
+			groupMap = append(groupMap, group)
 		}
+		sort.Slice(groupMap, func(i, j int) bool {
+			return groupMap[i].ID < groupMap[j].ID
+		})
 
 		phashGroupMap = groupMap
-		lastPHashFetch = uint64(time.Now().Unix())
+		phashGroupVersion = version
 	}
 
 	return phashGroupMap, nil
@@ -78,10 +161,12 @@ func GetPHashGroups() ([][]PHashEntry, error) {
  * @param limit The maximum number of results to return
  * @param shuffle Whether to return the results in a random order
  * @param rating Return only images with this rating [if nil, accepts all]
+ * @param collapseVariants Whether to return only the best image of every variant group
  * @return A list of ImageEntry objects, the total number of results, and a possible error
  */
-func SearchImages(query string, limit int, shuffle bool, rating string) ([]ImageEntry, int, error) {
+func SearchImages(query string, limit int, shuffle bool, rating string, collapseVariants bool) ([]ImageEntry, int, error) {
 	imageIndex := GetMeiliClient().Index("images")
+	filter := searchFilter(rating, collapseVariants)
 
 	// We first run a search to get the total results for this query
 	// This way we can run the "proper" search with a randomized offset, giving unique results every time
@@ -89,14 +174,15 @@ func SearchImages(query string, limit int, shuffle bool, rating string) ([]Image
 	var err error
 	if rating == "" {
 		resultCountSearch, err = imageIndex.Search(query, &meilisearch.SearchRequest{
-			Limit: 1,
-			Sort:  []string{"Added:desc"},
+			Limit:  1,
+			Filter: filter,
+			Sort:   []string{"Added:desc"},
 		})
 	} else {
 		log.Info("Searching with rating", rating)
 		resultCountSearch, err = imageIndex.Search(query, &meilisearch.SearchRequest{
 			Limit:  1,
-			Filter: "Rating = '" + rating + "'",
+			Filter: filter,
 		})
 	}
 
@@ -118,26 +204,28 @@ func SearchImages(query string, limit int, shuffle bool, rating string) ([]Image
 	var search *meilisearch.SearchResponse
 	if rating == "" && !shuffle {
 		search, err = imageIndex.Search(query, &meilisearch.SearchRequest{
-			Limit: int64(limit),
-			Sort:  []string{"Added:desc"},
+			Limit:  int64(limit),
+			Filter: filter,
+			Sort:   []string{"Added:desc"},
 		})
 	} else if rating == "" && shuffle {
 		search, err = imageIndex.Search(query, &meilisearch.SearchRequest{
 			Limit:  int64(limit),
 			Offset: int64(offset),
+			Filter: filter,
 			Sort:   []string{"Added:desc"},
 		})
 	} else if rating != "" && !shuffle {
 		search, err = imageIndex.Search(query, &meilisearch.SearchRequest{
 			Limit:  int64(limit),
 			Offset: int64(offset),
-			Filter: "Rating = '" + rating + "'",
+			Filter: filter,
 		})
 	} else {
 		search, err = imageIndex.Search(query, &meilisearch.SearchRequest{
 			Limit:  int64(limit),
 			Offset: int64(offset),
-			Filter: "Rating = '" + rating + "'",
+			Filter: filter,
 			Sort:   []string{"Added:desc"},
 		})
 	}
@@ -149,34 +237,7 @@ func SearchImages(query string, limit int, shuffle bool, rating string) ([]Image
 	var results []ImageEntry
 	for _, hit := range search.Hits {
 		value := hit.(map[string]interface{})
-		var tags []string
-		for _, tag := range value["Tags"].([]interface{}) {
-			// check if tag is a banned tag, if so don't include image
-			if ImageScraper.TagIsBanned(tag.(string)) {
-				continue
-			}
-			tags = append(tags, tag.(string))
-		}
-
-		thumbnail := GetImgproxyBaseUrl() + SignImgproxyURL("rs:fill:480/g:sm/plain/local:///"+value["Filename"].(string))
-		if strings.HasSuffix(thumbnail, ".webm") {
-			thumbnail = ""
-		}
-
-		results = append(results, ImageEntry{
-			ID:           value["ID"].(string),
-			URL:          GetBaseURL() + "/images/" + value["Filename"].(string),
-			ThumbnailURL: thumbnail,
-			Tags:         tags,
-			Tagstring:    value["Tagstring"].(string),
-			Rating:       Rating(value["Rating"].(string)),
-			Added:        value["Added"].(string),
-			PHash:        uint64(value["PHash"].(float64)),
-			Size:         int(value["Size"].(float64)),
-			Width:        int(value["Width"].(float64)),
-			Height:       int(value["Height"].(float64)),
-			Filename:     value["Filename"].(string),
-		})
+		results = append(results, imageEntryFromHit(value))
 	}
 	if shuffle {
 		rand.Shuffle(len(results), func(i, j int) {
@@ -192,9 +253,10 @@ func SearchImages(query string, limit int, shuffle bool, rating string) ([]Image
  * @param limit The number of results to return per page
  * @param page The page to return (1-indexed)
  * @param rating Return only images with this rating [if nil, accepts all]
+ * @param collapseVariants Whether to return only the best image of every variant group
  * @return A list of ImageEntry objects, the total number of results, and a possible error
  */
-func SearchImagesPaginated(query string, limit int, page int, rating string) ([]ImageEntry, int, error) {
+func SearchImagesPaginated(query string, limit int, page int, rating string, collapseVariants bool) ([]ImageEntry, int, error) {
 	sentry.AddBreadcrumb(&sentry.Breadcrumb{
 		Category: "search",
 		Message:  "Searching for " + query,
@@ -220,22 +282,12 @@ func SearchImagesPaginated(query string, limit int, page int, rating string) ([]
 		return []ImageEntry{}, 0, errors.New("page must be greater than 0")
 	}
 
-	var search *meilisearch.SearchResponse
-	var err error
-	if rating == "" {
-		search, err = imageIndex.Search(query, &meilisearch.SearchRequest{
-			Limit:  int64(limit),
-			Offset: int64((page + 1) * limit),
-			Sort:   []string{"Added:desc"},
-		})
-	} else {
-		search, err = imageIndex.Search(query, &meilisearch.SearchRequest{
-			Limit:  int64(limit),
-			Offset: int64((page + 1) * limit),
-			Filter: "Rating = '" + rating + "'",
-			Sort:   []string{"Added:desc"},
-		})
-	}
+	search, err := imageIndex.Search(query, &meilisearch.SearchRequest{
+		Limit:  int64(limit),
+		Offset: int64((page + 1) * limit),
+		Filter: searchFilter(rating, collapseVariants),
+		Sort:   []string{"Added:desc"},
+	})
 
 	if err != nil {
 		sentry.CaptureException(err)
@@ -245,37 +297,29 @@ func SearchImagesPaginated(query string, limit int, page int, rating string) ([]
 	var results []ImageEntry
 	for _, hit := range search.Hits {
 		value := hit.(map[string]interface{})
-		var tags []string
-		for _, tag := range value["Tags"].([]interface{}) {
-			// check if tag is a banned tag, if so don't include image
-			if ImageScraper.TagIsBanned(tag.(string)) {
-				continue
-			}
-			tags = append(tags, tag.(string))
-		}
+		results = append(results, imageEntryFromHit(value))
+	}
 
-		thumbnail := GetImgproxyBaseUrl() + SignImgproxyURL("rs:fill:480/g:sm/plain/local:///"+value["Filename"].(string))
-		if strings.HasSuffix(thumbnail, ".webm") {
-			thumbnail = ""
-		}
+	return results, int(search.EstimatedTotalHits), nil
+}
 
-		results = append(results, ImageEntry{
-			ID:           value["ID"].(string),
-			URL:          GetBaseURL() + "/images/" + value["Filename"].(string),
-			ThumbnailURL: thumbnail,
-			Tags:         tags,
-			Tagstring:    value["Tagstring"].(string),
-			Rating:       Rating(value["Rating"].(string)),
-			Added:        value["Added"].(string),
-			PHash:        uint64(value["PHash"].(float64)),
-			Size:         int(value["Size"].(float64)),
-			Width:        int(value["Width"].(float64)),
-			Height:       int(value["Height"].(float64)),
-			Filename:     value["Filename"].(string),
-		})
+// searchFilter builds the filter of a search, nil if it doesn't need one.
+// Collapsing filters instead of using a distinct attribute, since meilisearch only supports that for the whole index,
+// which would also collapse the lookup of related images.
+func searchFilter(rating string, collapseVariants bool) interface{} {
+	var filters []string
+	if rating != "" {
+		filters = append(filters, "Rating = '"+rating+"'")
+	}
+	// != also matches images indexed before GroupBest was stored, so they are never collapsed
+	if collapseVariants {
+		filters = append(filters, "GroupBest != false")
 	}
 
-	return results, int(search.EstimatedTotalHits), nil
+	if len(filters) == 0 {
+		return nil
+	}
+	return strings.Join(filters, " AND ")
 }
 
 /* GetImageByID returns an image matching the given ID
@@ -294,34 +338,40 @@ func GetImageEntryFromID(id string) (ImageEntry, error) {
 
 	image.URL = GetBaseURL() + "/images/" + image.Filename
 
-	thumbnail := GetImgproxyBaseUrl() + SignImgproxyURL("rs:fill:480/g:sm/plain/local:///"+image.Filename)
-	if strings.HasSuffix(thumbnail, ".webm") {
-		thumbnail = ""
-	}
-
-	image.ThumbnailURL = thumbnail
+	image.ThumbnailURL = thumbnailURL(image.Filename, image.MimeType, image.Poster)
 
 	return image, nil
 }
 
+// relatedLimit is the largest number of related images returned for an image
+const relatedLimit = 1000
+
 /* GetRelatedImages returns a list of images that are similar to the given image
  * Do not call this recursively, it will run infinitely
- * @param image The image to find similar images for
+ * @param id The image to find similar images for
+ * @param groupID The variant group of the image
  * @return A list of similar images
  */
-func GetRelatedImages(id string) ([]ImageEntry, error) {
-	images, err := GetRelatedImageIDs(id)
+func GetRelatedImages(id string, groupID string) ([]ImageEntry, error) {
+	if groupID == "" {
+		return nil, nil
+	}
+
+	search, err := GetMeiliClient().Index("images").Search("", &meilisearch.SearchRequest{
+		Limit:  relatedLimit,
+		Filter: "GroupID = '" + groupID + "' AND ID != '" + id + "'",
+	})
+	sentry.AddBreadcrumb(&sentry.Breadcrumb{
+		Category: "phash",
+		Message:  "Searched variant group " + groupID,
+	})
 	if err != nil {
 		return nil, err
 	}
 
 	var imageEntries []ImageEntry
-	for _, image := range images {
-		entry, err := GetImageEntryFromID(image)
-		if err != nil {
-			return nil, err
-		}
-		imageEntries = append(imageEntries, entry)
+	for _, hit := range search.Hits {
+		imageEntries = append(imageEntries, imageEntryFromHit(hit.(map[string]interface{})))
 	}
 
 	return imageEntries, nil
@@ -333,34 +383,147 @@ func GetRelatedImages(id string) ([]ImageEntry, error) {
  * @return A list of similar image IDs
  */
 func GetRelatedImageIDs(id string) ([]string, error) {
-	// Get the phash group for this image
-	phashGroups, err := GetPHashGroups()
-	sentry.AddBreadcrumb(&sentry.Breadcrumb{
-		Category: "phash",
-		Message:  fmt.Sprintf("Got phash groups, count: %d", len(phashGroups)),
+	image, err := GetImageEntryFromID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	related, err := GetRelatedImages(image.ID, image.GroupID)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, entry := range related {
+		ids = append(ids, entry.ID)
+	}
+
+	return ids, nil
+}
+
+// similarLimit is the largest number of similar images returned for an image
+const similarLimit = 100
+
+// similarIndex is the pHash index that similar images are looked up in, it is loaded on the first lookup
+var similarIndex = NewVariantMatcher(0)
+
+// SimilarImage is an image along with the Hamming distance of its pHash to the image it is similar to
+type SimilarImage struct {
+	Image    ImageEntry
+	Distance int
+}
+
+/* GetSimilarImages returns the images whose pHash is within maxDistance of the given image, closest first
+ * Unlike related images, they are not grouped, so images similar to a similar image are not included
+ * @param id The image to find similar images for
+ * @param hash The pHash of the image
+ * @param maxDistance The largest Hamming distance of the returned images, at most MaxVariantDistance
+ * @return A list of similar images and a possible error
+ */
+func GetSimilarImages(id string, hash uint64, maxDistance int) ([]SimilarImage, error) {
+	if hash == 0 {
+		return nil, nil
+	}
+	if maxDistance < 0 || maxDistance > MaxVariantDistance {
+		return nil, fmt.Errorf("maxDistance must be between 0 and %d", MaxVariantDistance)
+	}
+
+	neighbours, err := similarIndex.Search(hash, maxDistance)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []PHashEntry
+	for _, neighbour := range neighbours {
+		if neighbour.ID != id {
+			matches = append(matches, neighbour)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Distance != matches[j].Distance {
+			return matches[i].Distance < matches[j].Distance
+		}
+		return matches[i].ID < matches[j].ID
 	})
+	if len(matches) > similarLimit {
+		matches = matches[:similarLimit]
+	}
+	if len(matches) == 0 {
+		return nil, nil
+	}
 
+	filters := make([]string, 0, len(matches))
+	for _, match := range matches {
+		filters = append(filters, "ID = '"+match.ID+"'")
+	}
+	search, err := GetMeiliClient().Index("images").Search("", &meilisearch.SearchRequest{
+		Limit:  similarLimit,
+		Filter: strings.Join(filters, " OR "),
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	for _, group := range phashGroups {
-		for _, entry := range group {
-			if entry.ID == id {
-				// we found the group, generate slice with IDs, minus the given image
-				var ids []string
-				for _, entry := range group {
-					if entry.ID != id {
-						ids = append(ids, entry.ID)
-					}
-				}
+	images := make(map[string]ImageEntry, len(search.Hits))
+	for _, hit := range search.Hits {
+		image := imageEntryFromHit(hit.(map[string]interface{}))
+		images[image.ID] = image
+	}
 
-				return ids, nil
-			}
+	// images that were removed since the pHash index was built are skipped
+	var similar []SimilarImage
+	for _, match := range matches {
+		if image, ok := images[match.ID]; ok {
+			similar = append(similar, SimilarImage{Image: image, Distance: match.Distance})
+		}
+	}
+
+	return similar, nil
+}
+
+// ImageGroup is the variant group of an image as it is stored on its document
+type ImageGroup struct {
+	// ID is the ID of the group, empty if the image has no variants
+	ID string
+	// Best is whether the image is the best one of the group
+	Best bool
+}
+
+/* UpdateImageGroups writes the variant group onto the documents of images
+ * Images without variants are stored as the best image of their own group, so collapsed searches keep them
+ * @param groups The new group by image ID
+ */
+func UpdateImageGroups(groups map[string]ImageGroup) error {
+	updates := make([]map[string]interface{}, 0, len(groups))
+	for id, group := range groups {
+		if group.ID == "" {
+			group = ImageGroup{ID: id, Best: true}
 		}
+		updates = append(updates, map[string]interface{}{
+			"ID":        id,
+			"GroupID":   group.ID,
+			"GroupBest": group.Best,
+		})
 	}
 
-	return nil, nil
+	imageIndex := GetMeiliClient().Index("images")
+	for i := 0; i < len(updates); i += 1000 {
+		end := i + 1000
+		if end > len(updates) {
+			end = len(updates)
+		}
+
+		batch := updates[i:end]
+		taskInfo, err := imageIndex.UpdateDocuments(&batch)
+		if err != nil {
+			return err
+		}
+		if !WaitForMeilisearchTask(taskInfo) {
+			return errors.New("failed to update the groups of images")
+		}
+	}
+
+	return nil
 }
 
 /* GetRandomImage returns a random image from the database
@@ -382,7 +545,7 @@ func GetRandomImage() (ImageEntry, error) {
 	// and return one, which is random
 	var res meilisearch.DocumentsResult
 	err = imageIndex.GetDocuments(&meilisearch.DocumentsQuery{
-		Fields: []string{"ID", "PHash", "Filename", "Tagstring", "Tags", "Rating", "Added", "Size", "Width", "Height"},
+		Fields: []string{"ID", "PHash", "Filename", "Tagstring", "Tags", "Rating", "Added", "Size", "Width", "Height", "MimeType", "Duration", "VideoCodec", "HasAudio", "Poster", "SourceName", "SourcePostID", "SourceURL", "ArtworkSource", "Score", "Uploaded", "ParentID", "GroupID"},
 		Limit:  1,
 		Offset: int64(offset),
 	}, &res)
@@ -393,35 +556,7 @@ func GetRandomImage() (ImageEntry, error) {
 
 	var image ImageEntry
 	for _, hit := range res.Results {
-		value := hit
-		var tags []string
-		for _, tag := range value["Tags"].([]interface{}) {
-			// check if tag is a banned tag, if so don't include image
-			if ImageScraper.TagIsBanned(tag.(string)) {
-				continue
-			}
-			tags = append(tags, tag.(string))
-		}
-
-		thumbnail := GetImgproxyBaseUrl() + SignImgproxyURL("rs:fill:480/g:sm/plain/local:///"+value["Filename"].(string))
-		if strings.HasSuffix(thumbnail, ".webm") {
-			thumbnail = ""
-		}
-
-		image = ImageEntry{
-			ID:           value["ID"].(string),
-			URL:          GetBaseURL() + "/images/" + value["Filename"].(string),
-			ThumbnailURL: thumbnail,
-			Tags:         tags,
-			Tagstring:    value["Tagstring"].(string),
-			Rating:       Rating(value["Rating"].(string)),
-			Added:        value["Added"].(string),
-			PHash:        uint64(value["PHash"].(float64)),
-			Size:         int(value["Size"].(float64)),
-			Width:        int(value["Width"].(float64)),
-			Height:       int(value["Height"].(float64)),
-			Filename:     value["Filename"].(string),
-		}
+		image = imageEntryFromHit(hit)
 	}
 
 	return image, nil
@@ -433,35 +568,155 @@ func GetRandomImage() (ImageEntry, error) {
 func GetTotalImageCount() (int, error) {
 	imageIndex := GetMeiliClient().Index("images")
 
-	// We first run a search to get the total count of documents
+	// Searches only count one image of every variant group, so the documents are counted by the index stats
 	// This gives us an offset we can use to get a random image
-	resultCountSearch, err := imageIndex.Search("", &meilisearch.SearchRequest{
-		Limit: 1,
-	})
+	stats, err := imageIndex.GetStats()
 	if err != nil {
 		return 0, err
 	}
-	if resultCountSearch.EstimatedTotalHits == 0 {
-		return 0, nil
+
+	return int(stats.NumberOfDocuments), nil
+}
+
+// imageEntryFromHit converts a meilisearch hit into an ImageEntry, dropping banned tags and filling in the URLs.
+// Source metadata is optional, since documents indexed before it was stored don't have it.
+func imageEntryFromHit(value map[string]interface{}) ImageEntry {
+	var tags []string
+	for _, tag := range value["Tags"].([]interface{}) {
+		// check if tag is a banned tag, if so don't include image
+		if ImageScraper.TagIsBanned(tag.(string)) {
+			continue
+		}
+		tags = append(tags, tag.(string))
+	}
+
+	mimeType, _ := value["MimeType"].(string)
+	duration, _ := value["Duration"].(float64)
+	videoCodec, _ := value["VideoCodec"].(string)
+	hasAudio, _ := value["HasAudio"].(bool)
+	poster, _ := value["Poster"].(string)
+	sourceName, _ := value["SourceName"].(string)
+	sourcePostID, _ := value["SourcePostID"].(string)
+	sourceURL, _ := value["SourceURL"].(string)
+	artworkSource, _ := value["ArtworkSource"].(string)
+	score, _ := value["Score"].(float64)
+	uploaded, _ := value["Uploaded"].(string)
+	parentID, _ := value["ParentID"].(string)
+	groupID, _ := value["GroupID"].(string)
+	groupBest, _ := value["GroupBest"].(bool)
+	phash, _ := ParseStoredPHash(value["PHash"])
+
+	return ImageEntry{
+		ID:            value["ID"].(string),
+		URL:           GetBaseURL() + "/images/" + value["Filename"].(string),
+		ThumbnailURL:  thumbnailURL(value["Filename"].(string), mimeType, poster),
+		Tags:          tags,
+		Tagstring:     value["Tagstring"].(string),
+		Rating:        Rating(value["Rating"].(string)),
+		Added:         value["Added"].(string),
+		PHash:         StoredPHash(phash),
+		Size:          int(value["Size"].(float64)),
+		Width:         int(value["Width"].(float64)),
+		Height:        int(value["Height"].(float64)),
+		Filename:      value["Filename"].(string),
+		MimeType:      mimeType,
+		Duration:      duration,
+		VideoCodec:    videoCodec,
+		HasAudio:      hasAudio,
+		Poster:        poster,
+		SourceName:    sourceName,
+		SourcePostID:  sourcePostID,
+		SourceURL:     sourceURL,
+		ArtworkSource: artworkSource,
+		Score:         int(score),
+		Uploaded:      uploaded,
+		ParentID:      parentID,
+		GroupID:       groupID,
+		GroupBest:     groupBest,
+	}
+}
+
+// thumbnailURL returns the imgproxy thumbnail of an image.
+// Videos are thumbnailed by their poster frame, videos indexed before posters were extracted have no thumbnail.
+func thumbnailURL(filename string, mimeType string, poster string) string {
+	if poster != "" {
+		filename = poster
+	} else if strings.HasPrefix(mimeType, "video/") || strings.HasSuffix(filename, ".webm") || strings.HasSuffix(filename, ".mp4") {
+		return ""
 	}
 
-	return int(resultCountSearch.EstimatedTotalHits), nil
+	return GetImgproxyBaseUrl() + SignImgproxyURL("rs:fill:480/g:sm/plain/local:///"+filename)
 }
 
+func ImageEntryToVariantCandidate(image ImageEntry) VariantCandidate {
+	return VariantCandidate{
+		ID:     image.ID,
+		Hash:   uint64(image.PHash),
+		Width:  image.Width,
+		Height: image.Height,
+		Size:   image.Size,
+	}
+}
+
+// DBImageToGraphImage converts an image for the GraphQL API.
+// Use it instead of copier, which turns the pHash into a rune instead of its decimal string.
 func DBImageToGraphImage(image ImageEntry) *model.Image {
 	return &model.Image{
-		ID:           image.ID,
-		URL:          image.URL,
-		ThumbnailURL: image.ThumbnailURL,
-		Tags:         image.Tags,
-		Tagstring:    image.Tagstring,
-		Rating:       model.Rating(image.Rating),
-		Added:        image.Added,
-		PHash:        strconv.FormatUint(image.PHash, 10),
-		Size:         image.Size,
-		Width:        image.Width,
-		Height:       image.Height,
-		Filename:     image.Filename,
+		ID:            image.ID,
+		URL:           image.URL,
+		ThumbnailURL:  image.ThumbnailURL,
+		Tags:          image.Tags,
+		Tagstring:     image.Tagstring,
+		Rating:        model.Rating(image.Rating),
+		Added:         image.Added,
+		PHash:         strconv.FormatUint(uint64(image.PHash), 10),
+		Size:          image.Size,
+		Width:         image.Width,
+		Height:        image.Height,
+		Filename:      image.Filename,
+		MimeType:      image.MimeType,
+		Duration:      image.Duration,
+		VideoCodec:    image.VideoCodec,
+		HasAudio:      image.HasAudio,
+		SourceName:    image.SourceName,
+		SourcePostID:  image.SourcePostID,
+		SourceURL:     image.SourceURL,
+		ArtworkSource: image.ArtworkSource,
+		Score:         image.Score,
+		Uploaded:      image.Uploaded,
+		ParentID:      image.ParentID,
+		GroupID:       image.GroupID,
+	}
+}
+
+// DBImageToNestedImage converts an image like DBImageToGraphImage, for the images nested in another one
+func DBImageToNestedImage(image ImageEntry) *model.NestedImage {
+	converted := DBImageToGraphImage(image)
+	return &model.NestedImage{
+		ID:            converted.ID,
+		URL:           converted.URL,
+		ThumbnailURL:  converted.ThumbnailURL,
+		Tags:          converted.Tags,
+		Tagstring:     converted.Tagstring,
+		Rating:        converted.Rating,
+		Added:         converted.Added,
+		PHash:         converted.PHash,
+		Size:          converted.Size,
+		Width:         converted.Width,
+		Height:        converted.Height,
+		Filename:      converted.Filename,
+		MimeType:      converted.MimeType,
+		Duration:      converted.Duration,
+		VideoCodec:    converted.VideoCodec,
+		HasAudio:      converted.HasAudio,
+		SourceName:    converted.SourceName,
+		SourcePostID:  converted.SourcePostID,
+		SourceURL:     converted.SourceURL,
+		ArtworkSource: converted.ArtworkSource,
+		Score:         converted.Score,
+		Uploaded:      converted.Uploaded,
+		ParentID:      converted.ParentID,
+		GroupID:       converted.GroupID,
 	}
 }
 
@@ -0,0 +1,110 @@
+package Database
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+)
+
+// configureURLs sets up the URLs of hits, which are required to convert them
+func configureURLs() {
+	SetBaseURL("http://localhost:8080")
+	SetImgproxyBaseUrl("http://localhost:8081")
+	SetImgproxySecrets("6b6579", "73616c74")
+}
+
+func TestPHashSurvivesMeilisearchRoundTrip(t *testing.T) {
+	// the lowest bits of this pHash don't fit into a float64
+	const phash = 0xF0E1D2C3B4A59687
+
+	configureURLs()
+
+	document, err := json.Marshal(ImageEntry{ID: "a", Tags: []string{"hug"}, Rating: RatingSafe, Filename: "a.png", PHash: phash})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// search hits are decoded into maps, like the meilisearch client does
+	var hit map[string]interface{}
+	err = json.Unmarshal(document, &hit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image := imageEntryFromHit(hit); image.PHash != phash {
+		t.Errorf("pHash of the search hit changed from %d to %d", uint64(phash), uint64(image.PHash))
+	}
+	if hash, _ := ParseStoredPHash(hit["PHash"]); hash != phash {
+		t.Errorf("parsed pHash changed from %d to %d", uint64(phash), hash)
+	}
+
+	var image ImageEntry
+	err = json.Unmarshal(document, &image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.PHash != phash {
+		t.Errorf("pHash of the document changed from %d to %d", uint64(phash), uint64(image.PHash))
+	}
+}
+
+func TestStoredPHashReadsNumbersExactly(t *testing.T) {
+	// documents indexed before the pHash was stored as a string
+	var image ImageEntry
+	err := json.Unmarshal([]byte(`{"ID": "a", "PHash": 17357257042298869383}`), &image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.PHash != 17357257042298869383 {
+		t.Errorf("expected the exact pHash, got %d", uint64(image.PHash))
+	}
+}
+
+func TestIndexedImageFindsExactDuplicate(t *testing.T) {
+	configureURLs()
+
+	// the lowest bits of this pHash don't fit into a float64
+	const phash = 0xF0E1D2C3B4A59687
+	duplicate := ImageEntry{ID: "a", Tags: []string{"hug"}, Rating: RatingSafe, Filename: "a.png", PHash: phash, GroupID: "a"}
+	image := ImageEntry{ID: "b", Tags: []string{"hug"}, Rating: RatingSafe, Filename: "b.png", PHash: phash, GroupID: "b"}
+
+	// the duplicate is indexed by process mode, the image comes back from a search and is resolved through GraphQL
+	index := NewPHashIndex()
+	candidate := ImageEntryToVariantCandidate(duplicate)
+	index.Insert(candidate.ID, candidate.Hash)
+
+	document, err := json.Marshal(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hit map[string]interface{}
+	err = json.Unmarshal(document, &hit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	graphImage := DBImageToGraphImage(imageEntryFromHit(hit))
+	hash, err := strconv.ParseUint(graphImage.PHash, 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matches := index.Search(hash, 0)
+	if len(matches) != 1 || matches[0].ID != "a" || matches[0].Distance != 0 {
+		t.Errorf("expected the duplicate at distance 0, got %+v", matches)
+	}
+	if nested := DBImageToNestedImage(imageEntryFromHit(hit)); nested.PHash != graphImage.PHash {
+		t.Errorf("nested image has pHash %s instead of %s", nested.PHash, graphImage.PHash)
+	}
+}
+
+func TestSearchFilter(t *testing.T) {
+	if filter := searchFilter("", false); filter != nil {
+		t.Errorf("expected no filter, got %v", filter)
+	}
+	if filter := searchFilter("safe", false); filter != "Rating = 'safe'" {
+		t.Errorf("unexpected rating filter %v", filter)
+	}
+	// images without GroupBest have to pass the collapse filter
+	if filter := searchFilter("safe", true); filter != "Rating = 'safe' AND GroupBest != false" {
+		t.Errorf("unexpected collapsed filter %v", filter)
+	}
+}
@@ -0,0 +1,165 @@
+package Database
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Priority lanes of the metadata queue, ordered from highest to lowest priority
+const (
+	LaneInteractive  = "interactive"
+	LaneSubscription = "subscription"
+	LaneBackfill     = "backfill"
+)
+
+// Lane is a priority lane of the metadata queue.
+// Process mode claims from the lanes in proportion to their weights and falls back to the other lanes while the chosen one is empty.
+type Lane struct {
+	Name   string
+	Weight int
+}
+
+// Lanes are ordered from highest to lowest priority
+var Lanes = []Lane{
+	{Name: LaneInteractive, Weight: 6},
+	{Name: LaneSubscription, Weight: 3},
+	{Name: LaneBackfill, Weight: 1},
+}
+
+// laneIdleWait is how long a claim blocks on the top lane before polling all lanes again
+const laneIdleWait = time.Second
+
+func IsLane(name string) bool {
+	for _, lane := range Lanes {
+		if lane.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// LaneQueue returns the queue of a lane.
+// The backfill lane keeps the key of the former single queue, so batches queued by older builds are still processed.
+func LaneQueue(lane string) string {
+	if lane == LaneBackfill {
+		return MetadataQueue
+	}
+	return MetadataQueue + ":" + lane
+}
+
+/* SetLaneWeights changes the weights of the lanes
+ * @param spec Comma separated weights of the form "interactive=6,subscription=3,backfill=1", lanes that aren't listed keep their weight
+ */
+func SetLaneWeights(spec string) error {
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		name, value, found := strings.Cut(field, "=")
+		if !found {
+			return errors.New("invalid lane weight " + field + ", expected lane=weight")
+		}
+		weight, err := strconv.Atoi(value)
+		if err != nil || weight < 0 {
+			return errors.New("invalid weight of lane " + name + ": " + value)
+		}
+
+		known := false
+		for i := range Lanes {
+			if Lanes[i].Name == name {
+				Lanes[i].Weight = weight
+				known = true
+			}
+		}
+		if !known {
+			return errors.New("unknown lane " + name)
+		}
+	}
+	return nil
+}
+
+// LaneScheduler picks the lane to claim from next using smooth weighted round-robin,
+// so with weights 6/3/1 the lanes are interleaved instead of draining six interactive batches in a row.
+type LaneScheduler struct {
+	lanes   []Lane
+	current []int
+	mutex   sync.Mutex
+}
+
+func NewLaneScheduler(lanes []Lane) *LaneScheduler {
+	return &LaneScheduler{
+		lanes:   append([]Lane{}, lanes...),
+		current: make([]int, len(lanes)),
+	}
+}
+
+// order returns the lane chosen by the round-robin first, followed by the remaining lanes by priority
+func (s *LaneScheduler) order() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	total := 0
+	chosen := -1
+	for i, lane := range s.lanes {
+		s.current[i] += lane.Weight
+		total += lane.Weight
+		if lane.Weight > 0 && (chosen == -1 || s.current[i] > s.current[chosen]) {
+			chosen = i
+		}
+	}
+
+	names := make([]string, 0, len(s.lanes))
+	if chosen != -1 {
+		s.current[chosen] -= total
+		names = append(names, s.lanes[chosen].Name)
+	}
+	for i, lane := range s.lanes {
+		if i != chosen {
+			names = append(names, lane.Name)
+		}
+	}
+	return names
+}
+
+/* Claim claims the next payload from the lanes of queue
+ * @param ctx Cancels a blocking claim
+ * @param queue The work queue to claim from
+ * @param worker The ID of the claiming worker
+ * @param timeout How long to wait while all lanes are empty
+ * @return The lane the payload was claimed from and the payload, or ErrQueueEmpty if the timeout passed without one
+ */
+func (s *LaneScheduler) Claim(ctx context.Context, queue WorkQueue, worker string, timeout time.Duration) (string, string, error) {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		for _, lane := range s.order() {
+			payload, err := queue.TryClaim(LaneQueue(lane), worker)
+			if err == ErrQueueEmpty {
+				continue
+			}
+			return lane, payload, err
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return "", "", ErrQueueEmpty
+		}
+		if remaining > laneIdleWait {
+			remaining = laneIdleWait
+		}
+
+		// block on the top lane for a moment, the other lanes are polled again afterwards
+		topLane := s.lanes[0].Name
+		payload, err := queue.Claim(ctx, LaneQueue(topLane), worker, remaining)
+		if err == ErrQueueEmpty {
+			continue
+		}
+		return topLane, payload, err
+	}
+}
@@ -0,0 +1,40 @@
+package Database
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLaneSchedulerFollowsWeights(t *testing.T) {
+	scheduler := NewLaneScheduler([]Lane{{"a", 6}, {"b", 3}, {"c", 1}})
+
+	picks := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		picks[scheduler.order()[0]]++
+	}
+
+	if picks["a"] != 60 || picks["b"] != 30 || picks["c"] != 10 {
+		t.Errorf("expected 60/30/10 picks, got %v", picks)
+	}
+}
+
+func TestLaneSchedulerSkipsZeroWeight(t *testing.T) {
+	scheduler := NewLaneScheduler([]Lane{{"a", 0}, {"b", 1}})
+
+	order := scheduler.order()
+	if order[0] != "b" || order[1] != "a" {
+		t.Errorf("expected b before a, got %v", order)
+	}
+}
+
+func TestLaneSchedulerClaimFallsBack(t *testing.T) {
+	queue := NewMemoryWorkQueue()
+	scheduler := NewLaneScheduler(Lanes)
+	_ = queue.Push(LaneQueue(LaneBackfill), "old")
+
+	lane, payload, err := scheduler.Claim(context.Background(), queue, "w", time.Second)
+	if err != nil || lane != LaneBackfill || payload != "old" {
+		t.Errorf("expected old from backfill, got %q from %q (%v)", payload, lane, err)
+	}
+}
@@ -0,0 +1,128 @@
+package Database
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryWorkQueue is a WorkQueue that only lives in this process.
+// It is meant for the all-in-one mode, where producers and process mode share one binary.
+// Queued payloads are lost when the process exits.
+type MemoryWorkQueue struct {
+	mutex      sync.Mutex
+	queues     map[string][]string
+	processing map[string][]string
+	// pushed is closed and replaced whenever a payload is added, waking up all waiting claims
+	pushed chan struct{}
+}
+
+func NewMemoryWorkQueue() *MemoryWorkQueue {
+	return &MemoryWorkQueue{
+		queues:     make(map[string][]string),
+		processing: make(map[string][]string),
+		pushed:     make(chan struct{}),
+	}
+}
+
+// notify wakes up waiting claims, the mutex must be held
+func (q *MemoryWorkQueue) notify() {
+	close(q.pushed)
+	q.pushed = make(chan struct{})
+}
+
+func (q *MemoryWorkQueue) Push(queue string, payload string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.queues[queue] = append(q.queues[queue], payload)
+	q.notify()
+	return nil
+}
+
+func (q *MemoryWorkQueue) Claim(ctx context.Context, queue string, worker string, timeout time.Duration) (string, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		q.mutex.Lock()
+		payload, err := q.claim(queue, worker)
+		pushed := q.pushed
+		q.mutex.Unlock()
+		if err != ErrQueueEmpty {
+			return payload, err
+		}
+
+		select {
+		case <-pushed:
+		case <-deadline.C:
+			return "", ErrQueueEmpty
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+func (q *MemoryWorkQueue) TryClaim(queue string, worker string) (string, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.claim(queue, worker)
+}
+
+// claim moves the first payload of queue into the processing list of worker, the mutex must be held
+func (q *MemoryWorkQueue) claim(queue string, worker string) (string, error) {
+	payloads := q.queues[queue]
+	if len(payloads) == 0 {
+		return "", ErrQueueEmpty
+	}
+
+	payload := payloads[0]
+	q.queues[queue] = payloads[1:]
+	key := processingKey(queue, worker)
+	q.processing[key] = append(q.processing[key], payload)
+	return payload, nil
+}
+
+// removeProcessing removes the first occurrence of payload from the processing list of worker, the mutex must be held
+func (q *MemoryWorkQueue) removeProcessing(queue string, worker string, payload string) {
+	key := processingKey(queue, worker)
+	payloads := q.processing[key]
+	for i, claimed := range payloads {
+		if claimed == payload {
+			q.processing[key] = append(payloads[:i:i], payloads[i+1:]...)
+			break
+		}
+	}
+	if len(q.processing[key]) == 0 {
+		delete(q.processing, key)
+	}
+}
+
+func (q *MemoryWorkQueue) Ack(queue string, worker string, payload string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.removeProcessing(queue, worker, payload)
+	return nil
+}
+
+func (q *MemoryWorkQueue) Requeue(queue string, worker string, payload string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.removeProcessing(queue, worker, payload)
+	q.queues[queue] = append([]string{payload}, q.queues[queue]...)
+	q.notify()
+	return nil
+}
+
+// Heartbeat is a no-op, all workers of a MemoryWorkQueue die with the process
+func (q *MemoryWorkQueue) Heartbeat(worker string) error {
+	return nil
+}
+
+// ReclaimStale never reclaims anything, all workers of a MemoryWorkQueue die with the process
+func (q *MemoryWorkQueue) ReclaimStale(queue string) (int, error) {
+	return 0, nil
+}
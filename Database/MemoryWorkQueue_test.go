@@ -0,0 +1,54 @@
+package Database
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryWorkQueueClaimOrder(t *testing.T) {
+	queue := NewMemoryWorkQueue()
+	_ = queue.Push("q", "a")
+	_ = queue.Push("q", "b")
+
+	first, err := queue.Claim(context.Background(), "q", "w", time.Second)
+	if err != nil || first != "a" {
+		t.Fatalf("expected a, got %q (%v)", first, err)
+	}
+
+	// a requeued payload is claimed before the remaining ones
+	_ = queue.Requeue("q", "w", first)
+	again, err := queue.Claim(context.Background(), "q", "w", time.Second)
+	if err != nil || again != "a" {
+		t.Fatalf("expected requeued a, got %q (%v)", again, err)
+	}
+	_ = queue.Ack("q", "w", again)
+
+	second, err := queue.Claim(context.Background(), "q", "w", time.Second)
+	if err != nil || second != "b" {
+		t.Fatalf("expected b, got %q (%v)", second, err)
+	}
+}
+
+func TestMemoryWorkQueueClaimTimeout(t *testing.T) {
+	queue := NewMemoryWorkQueue()
+
+	_, err := queue.Claim(context.Background(), "q", "w", time.Millisecond*10)
+	if err != ErrQueueEmpty {
+		t.Errorf("expected ErrQueueEmpty, got %v", err)
+	}
+}
+
+func TestMemoryWorkQueueClaimWaitsForPush(t *testing.T) {
+	queue := NewMemoryWorkQueue()
+
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		_ = queue.Push("q", "late")
+	}()
+
+	payload, err := queue.Claim(context.Background(), "q", "w", time.Second)
+	if err != nil || payload != "late" {
+		t.Errorf("expected late, got %q (%v)", payload, err)
+	}
+}
@@ -71,6 +71,7 @@ func ExecuteMigrations() {
 	for _, migration := range migrationsToExecute {
 		log.Println("Executing migration for version ", migration.Version)
 		migration.Handler()
+		currentDBVersion = migration.Version
 		log.Println("Migration for version ", migration.Version, " executed")
 	}
 
@@ -89,7 +90,8 @@ func ExecuteMigrations() {
 	log.Println("Migrations finished in", time.Since(startTime))
 }
 
-// Wait for a meilisearch task to finish, return true if successful
+// Wait for a meilisearch task to finish, return true if successful.
+// Failing to get the status of the task counts as a failure, so the caller can retry or give up instead of the process exiting.
 func WaitForMeilisearchTask(info *meilisearch.TaskInfo) bool {
 	client := GetMeiliClient()
 
@@ -97,7 +99,7 @@ func WaitForMeilisearchTask(info *meilisearch.TaskInfo) bool {
 		task, err := client.GetTask(info.TaskUID)
 
 		if err != nil {
-			log.Fatal("Failed to get task:", err)
+			log.Error("Failed to get task:", err)
 			return false
 		}
 		if task.Status == "failed" {
@@ -1,7 +1,9 @@
 package Database
 
+// PHashEntry is a member of a variant group.
+// The hash is encoded as a JSON string, since JSON numbers can't hold a uint64 in most languages.
 type PHashEntry struct {
-	ID       string
-	Hash     uint64
-	Distance int
+	ID       string `json:"id"`
+	Hash     uint64 `json:"hash,string"`
+	Distance int    `json:"distance"`
 }
@@ -0,0 +1,123 @@
+package Database
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// HammingDistance is the number of bits in which two pHashes differ
+func HammingDistance(a uint64, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// phashChunks is the number of 16 bit chunks a pHash is split into
+const phashChunks = 4
+
+// chunkMasks are all 16 bit values ordered by their number of set bits, chunkMaskCount[r] of them have at most r bits set
+var chunkMasks []uint16
+var chunkMaskCount [17]int
+
+func init() {
+	chunkMasks = make([]uint16, 0, 1<<16)
+	for i := 0; i < 1<<16; i++ {
+		chunkMasks = append(chunkMasks, uint16(i))
+	}
+	sort.SliceStable(chunkMasks, func(i, j int) bool {
+		return bits.OnesCount16(chunkMasks[i]) < bits.OnesCount16(chunkMasks[j])
+	})
+	for _, mask := range chunkMasks {
+		for r := bits.OnesCount16(mask); r <= 16; r++ {
+			chunkMaskCount[r]++
+		}
+	}
+}
+
+func hashChunk(hash uint64, chunk int) uint16 {
+	return uint16(hash >> (16 * chunk))
+}
+
+// PHashIndex finds the pHashes within a Hamming distance without comparing against every indexed hash.
+// It uses multi-index hashing: a pHash is split into 4 chunks of 16 bits that are indexed separately.
+// Two hashes within distance d have at least one chunk within distance d/4, so a search only has to look up
+// the buckets of chunks that differ in at most d/4 bits and verify the hashes found there.
+type PHashIndex struct {
+	entries []PHashEntry
+	tables  [phashChunks][][]int32
+}
+
+func NewPHashIndex() *PHashIndex {
+	index := &PHashIndex{}
+	for chunk := range index.tables {
+		index.tables[chunk] = make([][]int32, 1<<16)
+	}
+	return index
+}
+
+// Len returns the number of indexed hashes
+func (index *PHashIndex) Len() int {
+	return len(index.entries)
+}
+
+// Insert adds the hash of an image to the index, images with identical hashes are kept as separate entries
+func (index *PHashIndex) Insert(id string, hash uint64) {
+	position := int32(len(index.entries))
+	index.entries = append(index.entries, PHashEntry{ID: id, Hash: hash})
+
+	for chunk := range index.tables {
+		bucket := hashChunk(hash, chunk)
+		index.tables[chunk][bucket] = append(index.tables[chunk][bucket], position)
+	}
+}
+
+/* Search returns all images whose hash is within maxDistance of hash
+ * @param hash The hash to find the neighbours of
+ * @param maxDistance The largest Hamming distance to include
+ * @return The matching images with their distance to hash, in insertion order
+ */
+func (index *PHashIndex) Search(hash uint64, maxDistance int) []PHashEntry {
+	var matches []int32
+	if maxDistance < 0 {
+		return nil
+	}
+
+	radius := maxDistance / phashChunks
+	if radius > 16 {
+		radius = 16
+	}
+	masks := chunkMasks[:chunkMaskCount[radius]]
+
+	for chunk := range index.tables {
+		needle := hashChunk(hash, chunk)
+		for _, mask := range masks {
+			for _, position := range index.tables[chunk][needle^mask] {
+				candidate := index.entries[position].Hash
+				if HammingDistance(candidate, hash) > maxDistance || foundInEarlierChunk(candidate, hash, chunk, radius) {
+					continue
+				}
+				matches = append(matches, position)
+			}
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i] < matches[j]
+	})
+	entries := make([]PHashEntry, 0, len(matches))
+	for _, position := range matches {
+		entry := index.entries[position]
+		entry.Distance = HammingDistance(entry.Hash, hash)
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// foundInEarlierChunk reports whether a search already found candidate through one of the chunks before chunk,
+// which keeps every match from being reported once per close chunk
+func foundInEarlierChunk(candidate uint64, hash uint64, chunk int, radius int) bool {
+	for earlier := 0; earlier < chunk; earlier++ {
+		if bits.OnesCount16(hashChunk(candidate, earlier)^hashChunk(hash, earlier)) <= radius {
+			return true
+		}
+	}
+	return false
+}
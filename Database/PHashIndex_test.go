@@ -0,0 +1,98 @@
+package Database
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+// syntheticHashes returns count random hashes, every fourth being a variant of an earlier one with up to 12 flipped bits
+func syntheticHashes(count int) []uint64 {
+	random := rand.New(rand.NewSource(1))
+
+	hashes := make([]uint64, count)
+	for i := range hashes {
+		if i > 0 && i%4 == 0 {
+			hash := hashes[random.Intn(i)]
+			for flips := random.Intn(13); flips > 0; flips-- {
+				hash ^= 1 << uint(random.Intn(64))
+			}
+			hashes[i] = hash
+			continue
+		}
+		hashes[i] = random.Uint64()
+	}
+	return hashes
+}
+
+func linearSearch(hashes []uint64, hash uint64, maxDistance int) []PHashEntry {
+	var matches []PHashEntry
+	for i, other := range hashes {
+		if distance := HammingDistance(hash, other); distance <= maxDistance {
+			matches = append(matches, PHashEntry{ID: strconv.Itoa(i), Hash: other, Distance: distance})
+		}
+	}
+	return matches
+}
+
+func TestPHashIndexMatchesLinearSearch(t *testing.T) {
+	hashes := syntheticHashes(5000)
+	index := NewPHashIndex()
+	for i, hash := range hashes {
+		index.Insert(strconv.Itoa(i), hash)
+	}
+	if index.Len() != len(hashes) {
+		t.Fatalf("expected %d hashes in index, got %d", len(hashes), index.Len())
+	}
+
+	for _, maxDistance := range []int{0, 3, 9, 10, 15} {
+		for i := 0; i < len(hashes); i += 7 {
+			expected := linearSearch(hashes, hashes[i], maxDistance)
+			actual := index.Search(hashes[i], maxDistance)
+
+			if len(expected) != len(actual) {
+				t.Fatalf("hash %d, distance %d: expected %v, got %v", i, maxDistance, expected, actual)
+			}
+			for j := range expected {
+				if expected[j] != actual[j] {
+					t.Fatalf("hash %d, distance %d: expected %v, got %v", i, maxDistance, expected, actual)
+				}
+			}
+		}
+	}
+}
+
+func TestPHashIndexKeepsIdenticalHashes(t *testing.T) {
+	index := NewPHashIndex()
+	index.Insert("a", 42)
+	index.Insert("b", 42)
+
+	matches := index.Search(42, 0)
+	if len(matches) != 2 || matches[0].ID != "a" || matches[1].ID != "b" {
+		t.Errorf("expected both identical hashes, got %v", matches)
+	}
+}
+
+const benchmarkHashCount = 100000
+
+func BenchmarkLinearSearch(b *testing.B) {
+	hashes := syntheticHashes(benchmarkHashCount)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		linearSearch(hashes, hashes[i%len(hashes)], 9)
+	}
+}
+
+func BenchmarkPHashIndexSearch(b *testing.B) {
+	hashes := syntheticHashes(benchmarkHashCount)
+	index := NewPHashIndex()
+	for i, hash := range hashes {
+		index.Insert(strconv.Itoa(i), hash)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		index.Search(hashes[i%len(hashes)], 9)
+	}
+}
@@ -0,0 +1,109 @@
+package Database
+
+import (
+	"Paktum/ImageScraper"
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// PayloadVersion is the schema version of the payloads written by this build.
+// Bump it whenever a change to the payload data isn't backwards compatible.
+const PayloadVersion = 1
+
+const (
+	// PayloadTypeImageBatch is a batch of scraped images on paktum:metadata_process, the data is an array of ImageScraper.Image
+	PayloadTypeImageBatch = "image_batch"
+	// PayloadTypeImageGroups are the variant groups in paktum:image_alts as written by older builds, the data is an array of arrays of PHashEntry
+	PayloadTypeImageGroups = "image_groups"
+	// PayloadTypeVariantGroups are the variant groups in paktum:image_alts as written by older builds, the data is an array of VariantGroup
+	PayloadTypeVariantGroups = "variant_groups"
+	// PayloadTypeVariantGroup is a single variant group in paktum:variant_groups, the data is a VariantGroup
+	PayloadTypeVariantGroup = "variant_group"
+)
+
+// Envelope wraps every JSON payload exchanged through redis
+type Envelope struct {
+	Version int             `json:"version"`
+	Type    string          `json:"type"`
+	Data    json.RawMessage `json:"data"`
+}
+
+func encodePayload(payloadType string, data interface{}) ([]byte, error) {
+	encodedData, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(Envelope{
+		Version: PayloadVersion,
+		Type:    payloadType,
+		Data:    encodedData,
+	})
+}
+
+// decodePayload decodes a JSON envelope of payloadType into data.
+// Payloads that aren't JSON envelopes are decoded as legacy gob, as written by builds before the envelope was introduced.
+// Gob support is only kept for the transition and will be removed once no legacy payloads are in flight anymore.
+func decodePayload(payload []byte, payloadType string, data interface{}) error {
+	var envelope Envelope
+	if err := json.Unmarshal(payload, &envelope); err != nil || envelope.Version == 0 {
+		dec := gob.NewDecoder(bytes.NewBuffer(payload))
+		if gobErr := dec.Decode(data); gobErr != nil {
+			return errors.New("payload is neither a JSON envelope nor legacy gob: " + gobErr.Error())
+		}
+		return nil
+	}
+
+	if envelope.Version > PayloadVersion {
+		return fmt.Errorf("payload version %d is newer than the supported version %d", envelope.Version, PayloadVersion)
+	}
+	if envelope.Type != payloadType {
+		return fmt.Errorf("expected payload of type %s, got %s", payloadType, envelope.Type)
+	}
+
+	return json.Unmarshal(envelope.Data, data)
+}
+
+func EncodeImageBatch(images []ImageScraper.Image) ([]byte, error) {
+	return encodePayload(PayloadTypeImageBatch, images)
+}
+
+func DecodeImageBatch(payload []byte) ([]ImageScraper.Image, error) {
+	var images []ImageScraper.Image
+	err := decodePayload(payload, PayloadTypeImageBatch, &images)
+	return images, err
+}
+
+func DecodeImageGroups(payload []byte) ([][]PHashEntry, error) {
+	var groups [][]PHashEntry
+	err := decodePayload(payload, PayloadTypeImageGroups, &groups)
+	return groups, err
+}
+
+func EncodeVariantGroup(group VariantGroup) ([]byte, error) {
+	return encodePayload(PayloadTypeVariantGroup, group)
+}
+
+func DecodeVariantGroup(payload []byte) (VariantGroup, error) {
+	var group VariantGroup
+	err := decodePayload(payload, PayloadTypeVariantGroup, &group)
+	return group, err
+}
+
+// DecodeVariantGroups decodes the variant groups written by older builds, including the image groups of even older ones
+func DecodeVariantGroups(payload []byte) ([]VariantGroup, error) {
+	var groups []VariantGroup
+	err := decodePayload(payload, PayloadTypeVariantGroups, &groups)
+	if err == nil {
+		return groups, nil
+	}
+
+	imageGroups, legacyErr := DecodeImageGroups(payload)
+	if legacyErr != nil {
+		return nil, err
+	}
+	return variantGroupsFromImageGroups(imageGroups), nil
+}
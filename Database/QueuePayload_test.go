@@ -0,0 +1,72 @@
+package Database
+
+import (
+	"Paktum/ImageScraper"
+	"bytes"
+	"encoding/gob"
+	"testing"
+)
+
+func TestDecodeImageBatchEnvelope(t *testing.T) {
+	payload, err := EncodeImageBatch([]ImageScraper.Image{{ID: "1", Filename: "a.png", Tags: []string{"hug"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	images, err := DecodeImageBatch(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].Filename != "a.png" || images[0].Tags[0] != "hug" {
+		t.Errorf("unexpected images %v", images)
+	}
+}
+
+func TestDecodeImageBatchLegacyGob(t *testing.T) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode([]ImageScraper.Image{{ID: "2", Filename: "b.jpg"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	images, err := DecodeImageBatch(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].ID != "2" {
+		t.Errorf("unexpected images %v", images)
+	}
+}
+
+func TestDecodePayloadRejectsNewerVersion(t *testing.T) {
+	_, err := DecodeImageGroups([]byte(`{"version": 999, "type": "image_groups", "data": []}`))
+	if err == nil {
+		t.Error("expected payload from a newer version to be rejected")
+	}
+}
+
+func TestVariantGroupKeepsFullHash(t *testing.T) {
+	payload, err := EncodeVariantGroup(VariantGroup{ID: "a", Best: "a", Members: []PHashEntry{{ID: "a", Hash: 18446744073709551615}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	group, err := DecodeVariantGroup(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group.Members[0].Hash != 18446744073709551615 {
+		t.Errorf("hash lost precision: %d", group.Members[0].Hash)
+	}
+}
+
+func TestDecodeVariantGroupsFromImageGroups(t *testing.T) {
+	groups, err := DecodeVariantGroups([]byte(`{"version": 1, "type": "image_groups", "data": [[{"id": "c", "hash": "3"}, {"id": "b", "hash": "2"}]]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(groups) != 1 || groups[0].ID != "b" || len(groups[0].Members) != 2 || groups[0].Members[1].ID != "c" {
+		t.Errorf("unexpected groups: %+v", groups)
+	}
+}
@@ -0,0 +1,88 @@
+package Database
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+// RedisWorkQueue is a WorkQueue backed by redis lists, so it can be shared by several processes
+type RedisWorkQueue struct{}
+
+func heartbeatKey(worker string) string {
+	return "paktum:worker:" + worker
+}
+
+func (RedisWorkQueue) Push(queue string, payload string) error {
+	return GetRedis().RPush(context.Background(), queue, payload).Err()
+}
+
+func (RedisWorkQueue) Claim(ctx context.Context, queue string, worker string, timeout time.Duration) (string, error) {
+	payload, err := GetRedis().BLMove(ctx, queue, processingKey(queue, worker), "LEFT", "RIGHT", timeout).Result()
+	if err == redis.Nil {
+		return "", ErrQueueEmpty
+	}
+	return payload, err
+}
+
+func (RedisWorkQueue) TryClaim(queue string, worker string) (string, error) {
+	payload, err := GetRedis().LMove(context.Background(), queue, processingKey(queue, worker), "LEFT", "RIGHT").Result()
+	if err == redis.Nil {
+		return "", ErrQueueEmpty
+	}
+	return payload, err
+}
+
+func (RedisWorkQueue) Ack(queue string, worker string, payload string) error {
+	return GetRedis().LRem(context.Background(), processingKey(queue, worker), 1, payload).Err()
+}
+
+func (RedisWorkQueue) Requeue(queue string, worker string, payload string) error {
+	_, err := GetRedis().TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		pipe.LRem(context.Background(), processingKey(queue, worker), 1, payload)
+		pipe.LPush(context.Background(), queue, payload)
+		return nil
+	})
+	return err
+}
+
+func (RedisWorkQueue) Heartbeat(worker string) error {
+	return GetRedis().Set(context.Background(), heartbeatKey(worker), time.Now().Unix(), WorkerHeartbeatTTL).Err()
+}
+
+// ReclaimStale treats a worker as dead once its heartbeat key expired
+func (RedisWorkQueue) ReclaimStale(queue string) (int, error) {
+	ctx := context.Background()
+	reclaimed := 0
+
+	iter := GetRedis().Scan(ctx, 0, processingKey(queue, "*"), 100).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		worker := strings.TrimPrefix(key, processingKey(queue, ""))
+
+		alive, err := GetRedis().Exists(ctx, heartbeatKey(worker)).Result()
+		if err != nil {
+			return reclaimed, err
+		}
+		if alive > 0 {
+			continue
+		}
+
+		for {
+			// the oldest claimed batch is moved first and ends up at the front of the queue
+			_, err := GetRedis().LMove(ctx, key, queue, "RIGHT", "LEFT").Result()
+			if err == redis.Nil {
+				break
+			}
+			if err != nil {
+				return reclaimed, err
+			}
+			reclaimed++
+		}
+		log.Info("Reclaimed batches of dead worker ", worker)
+	}
+
+	return reclaimed, iter.Err()
+}
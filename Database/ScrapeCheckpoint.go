@@ -0,0 +1,45 @@
+package Database
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"strconv"
+)
+
+// checkpointKey is the redis hash storing the highest post ID seen per scrape query
+const checkpointKey = "paktum:scrape_checkpoints"
+
+// setCheckpointScript only replaces the checkpoint with a higher one, in one step so that concurrent runs of a query can't move it backwards
+var setCheckpointScript = redis.NewScript(`
+local current = tonumber(redis.call("HGET", KEYS[1], ARGV[1]) or "0")
+if tonumber(ARGV[2]) > current then
+	redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+/* GetScrapeCheckpoint returns the highest post ID seen for a scrape query
+ * @param query The key of the query, as returned by ImageScraper.Query.Key
+ * @return The highest post ID, or 0 if the query has no checkpoint yet
+ */
+func GetScrapeCheckpoint(query string) (int, error) {
+	checkpoint, err := GetRedis().HGet(context.Background(), checkpointKey, query).Result()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(checkpoint)
+}
+
+/* SetScrapeCheckpoint stores the highest post ID seen for a scrape query
+ * Lower IDs than the stored checkpoint are ignored, so the checkpoint never moves backwards
+ * @param query The key of the query, as returned by ImageScraper.Query.Key
+ * @param id The highest post ID seen in this run
+ */
+func SetScrapeCheckpoint(query string, id int) error {
+	return setCheckpointScript.Run(context.Background(), GetRedis(), []string{checkpointKey}, query, id).Err()
+}
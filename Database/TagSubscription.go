@@ -0,0 +1,235 @@
+package Database
+
+import (
+	"Paktum/ImageScraper"
+	"Paktum/graph/model"
+	"context"
+	"errors"
+	"github.com/go-redis/redis/v8"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// TagSubscription is a scrape query that the scheduler runs periodically
+type TagSubscription struct {
+	ID    string
+	Query string
+	// Interval between runs in seconds
+	Interval int
+	// LastRun and NextRun are UNIX timestamps, LastRun is 0 if the subscription never ran
+	LastRun   int64
+	NextRun   int64
+	LastError string
+}
+
+// MinSubscriptionInterval is the shortest interval a subscription may run at, in seconds
+const MinSubscriptionInterval = 60
+
+const subscriptionSetKey = "paktum:subscriptions"
+const subscriptionIDKey = "paktum:subscription_id"
+
+// every subscription is stored as its own hash, so the scheduler can record runs without overwriting edits from the API
+func subscriptionKey(id string) string {
+	return "paktum:subscription:" + id
+}
+
+func validateSubscription(query string, interval int) error {
+	err, parsedQuery := ImageScraper.ParseQuery(query)
+	if err != nil {
+		return err
+	}
+	if parsedQuery.Lane != "" && !IsLane(parsedQuery.Lane) {
+		return errors.New("unknown lane " + parsedQuery.Lane)
+	}
+	if interval < MinSubscriptionInterval {
+		return errors.New("interval must be at least " + strconv.Itoa(MinSubscriptionInterval) + " seconds")
+	}
+	return nil
+}
+
+/* CreateTagSubscription stores a new subscription, which is due immediately
+ * @param query The scrape query, in the same format as the lines read by scrape mode
+ * @param interval The interval between runs in seconds
+ * @return The created subscription and a possible error
+ */
+func CreateTagSubscription(query string, interval int) (TagSubscription, error) {
+	err := validateSubscription(query, interval)
+	if err != nil {
+		return TagSubscription{}, err
+	}
+
+	id, err := GetRedis().Incr(context.Background(), subscriptionIDKey).Result()
+	if err != nil {
+		return TagSubscription{}, err
+	}
+
+	subscription := TagSubscription{
+		ID:       strconv.FormatInt(id, 10),
+		Query:    query,
+		Interval: interval,
+		NextRun:  time.Now().Unix(),
+	}
+
+	_, err = GetRedis().TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		pipe.HSet(context.Background(), subscriptionKey(subscription.ID),
+			"Query", subscription.Query,
+			"Interval", subscription.Interval,
+			"LastRun", subscription.LastRun,
+			"NextRun", subscription.NextRun,
+			"LastError", subscription.LastError,
+		)
+		pipe.SAdd(context.Background(), subscriptionSetKey, subscription.ID)
+		return nil
+	})
+	if err != nil {
+		return TagSubscription{}, err
+	}
+
+	return subscription, nil
+}
+
+/* UpdateTagSubscription changes the query and interval of a subscription
+ * The next run is rescheduled relative to the last run
+ * @param id The ID of the subscription
+ * @param query The new scrape query
+ * @param interval The new interval in seconds
+ * @return The updated subscription and a possible error
+ */
+func UpdateTagSubscription(id string, query string, interval int) (TagSubscription, error) {
+	err := validateSubscription(query, interval)
+	if err != nil {
+		return TagSubscription{}, err
+	}
+
+	subscription, err := GetTagSubscription(id)
+	if err != nil {
+		return TagSubscription{}, err
+	}
+
+	subscription.Query = query
+	subscription.Interval = interval
+	if subscription.LastRun != 0 {
+		subscription.NextRun = subscription.LastRun + int64(interval)
+	}
+
+	err = GetRedis().HSet(context.Background(), subscriptionKey(id),
+		"Query", subscription.Query,
+		"Interval", subscription.Interval,
+		"NextRun", subscription.NextRun,
+	).Err()
+	if err != nil {
+		return TagSubscription{}, err
+	}
+
+	return subscription, nil
+}
+
+/* RemoveTagSubscription deletes a subscription
+ * @param id The ID of the subscription
+ * @return Whether the subscription existed, and a possible error
+ */
+func RemoveTagSubscription(id string) (bool, error) {
+	removed, err := GetRedis().SRem(context.Background(), subscriptionSetKey, id).Result()
+	if err != nil {
+		return false, err
+	}
+
+	err = GetRedis().Del(context.Background(), subscriptionKey(id)).Err()
+	if err != nil {
+		return false, err
+	}
+
+	return removed > 0, nil
+}
+
+/* RecordTagSubscriptionRun stores the outcome of a scheduler run
+ * Subscriptions that were removed in the meantime are left removed
+ * @param id The ID of the subscription
+ * @param lastRun When the run started, as UNIX timestamp
+ * @param nextRun When the next run is due, as UNIX timestamp
+ * @param runErr The error of the run, or nil if it succeeded
+ */
+func RecordTagSubscriptionRun(id string, lastRun int64, nextRun int64, runErr error) error {
+	exists, err := GetRedis().SIsMember(context.Background(), subscriptionSetKey, id).Result()
+	if err != nil || !exists {
+		return err
+	}
+
+	lastError := ""
+	if runErr != nil {
+		lastError = runErr.Error()
+	}
+
+	return GetRedis().HSet(context.Background(), subscriptionKey(id),
+		"LastRun", lastRun,
+		"NextRun", nextRun,
+		"LastError", lastError,
+	).Err()
+}
+
+/* GetTagSubscription returns the subscription with the given ID
+ * @param id The ID of the subscription
+ * @return The subscription and a possible error
+ */
+func GetTagSubscription(id string) (TagSubscription, error) {
+	fields, err := GetRedis().HGetAll(context.Background(), subscriptionKey(id)).Result()
+	if err != nil {
+		return TagSubscription{}, err
+	}
+	if len(fields) == 0 {
+		return TagSubscription{}, errors.New("subscription " + id + " not found")
+	}
+
+	interval, _ := strconv.Atoi(fields["Interval"])
+	lastRun, _ := strconv.ParseInt(fields["LastRun"], 10, 64)
+	nextRun, _ := strconv.ParseInt(fields["NextRun"], 10, 64)
+
+	return TagSubscription{
+		ID:        id,
+		Query:     fields["Query"],
+		Interval:  interval,
+		LastRun:   lastRun,
+		NextRun:   nextRun,
+		LastError: fields["LastError"],
+	}, nil
+}
+
+/* GetTagSubscriptions returns all subscriptions
+ * @return A list of subscriptions and a possible error
+ */
+func GetTagSubscriptions() ([]TagSubscription, error) {
+	ids, err := GetRedis().SMembers(context.Background(), subscriptionSetKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	// IDs are generated by INCR, so sorting them numerically returns subscriptions in creation order
+	sort.Slice(ids, func(i, j int) bool {
+		a, _ := strconv.Atoi(ids[i])
+		b, _ := strconv.Atoi(ids[j])
+		return a < b
+	})
+
+	subscriptions := make([]TagSubscription, 0, len(ids))
+	for _, id := range ids {
+		subscription, err := GetTagSubscription(id)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+
+	return subscriptions, nil
+}
+
+func DBSubscriptionToGraphSubscription(subscription TagSubscription) *model.TagSubscription {
+	return &model.TagSubscription{
+		ID:        subscription.ID,
+		Query:     subscription.Query,
+		Interval:  subscription.Interval,
+		LastRun:   strconv.FormatInt(subscription.LastRun, 10),
+		NextRun:   strconv.FormatInt(subscription.NextRun, 10),
+		LastError: subscription.LastError,
+	}
+}
@@ -0,0 +1,358 @@
+package Database
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"sort"
+	"strings"
+)
+
+// VariantGroup is a set of images whose pHashes are close to each other, either directly or through other members
+type VariantGroup struct {
+	// ID is assigned when the group is created and kept while it grows, a merged group keeps the ID of its largest part
+	ID string `json:"id"`
+	// Best is the ID of the member that represents the group, the one with the highest resolution
+	Best string `json:"best"`
+	// Members are sorted by ID, their distance is the one to the best member
+	Members []PHashEntry `json:"members"`
+}
+
+// VariantCandidate is an image that is considered for variant grouping
+type VariantCandidate struct {
+	ID     string `json:"id"`
+	Hash   uint64 `json:"hash,string"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Size   int    `json:"size"`
+}
+
+// unionFind tracks the connected components of candidates by their index.
+// The root of a component is always its lowest index, which doesn't depend on the order of the unions.
+type unionFind []int
+
+func newUnionFind(size int) unionFind {
+	parent := make(unionFind, size)
+	for i := range parent {
+		parent[i] = i
+	}
+	return parent
+}
+
+func (parent unionFind) find(i int) int {
+	for parent[i] != i {
+		parent[i] = parent[parent[i]]
+		i = parent[i]
+	}
+	return i
+}
+
+func (parent unionFind) union(a, b int) {
+	rootA, rootB := parent.find(a), parent.find(b)
+	if rootA < rootB {
+		parent[rootB] = rootA
+	} else if rootB < rootA {
+		parent[rootA] = rootB
+	}
+}
+
+// betterVariant reports whether a should represent a group rather than b: higher resolution, then larger file, then lower ID
+func betterVariant(a, b VariantCandidate) bool {
+	if a.Width*a.Height != b.Width*b.Height {
+		return a.Width*a.Height > b.Width*b.Height
+	}
+	if a.Size != b.Size {
+		return a.Size > b.Size
+	}
+	return a.ID < b.ID
+}
+
+/* GroupVariants groups all candidates that are connected by pHashes within maxDistance of each other
+ * Images without a pHash and images without any variant are left out
+ * Every group keeps the previous group ID that most of its members had, groups without one get a new ID
+ * The result is the same regardless of the order of the candidates
+ * @param candidates The images to group, every ID must only appear once
+ * @param previous The previous group ID by image ID, nil if there are no previous groups
+ * @param maxDistance The largest Hamming distance between two variants
+ * @return The groups, sorted by ID
+ */
+func GroupVariants(candidates []VariantCandidate, previous map[string]string, maxDistance int) []VariantGroup {
+	sorted := make([]VariantCandidate, 0, len(candidates))
+	for _, candidate := range candidates {
+		if candidate.Hash != 0 {
+			sorted = append(sorted, candidate)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].ID < sorted[j].ID
+	})
+
+	positions := make(map[string]int, len(sorted))
+	components := newUnionFind(len(sorted))
+	index := NewPHashIndex()
+	for i, candidate := range sorted {
+		for _, other := range index.Search(candidate.Hash, maxDistance) {
+			components.union(positions[other.ID], i)
+		}
+		positions[candidate.ID] = i
+		index.Insert(candidate.ID, candidate.Hash)
+	}
+
+	members := make(map[int][]int)
+	for i := range sorted {
+		root := components.find(i)
+		members[root] = append(members[root], i)
+	}
+
+	var connected [][]VariantCandidate
+	for i := range sorted {
+		// roots are visited in ascending order, and so are the members of each root
+		if components.find(i) != i || len(members[i]) < 2 {
+			continue
+		}
+
+		group := make([]VariantCandidate, 0, len(members[i]))
+		for _, member := range members[i] {
+			group = append(group, sorted[member])
+		}
+		connected = append(connected, group)
+	}
+
+	ids := keepVariantGroupIDs(connected, previous)
+	groups := make([]VariantGroup, 0, len(connected))
+	for i, group := range connected {
+		groups = append(groups, newVariantGroup(ids[i], group))
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].ID < groups[j].ID
+	})
+
+	return groups
+}
+
+// keepVariantGroupIDs picks the ID of every group of connected members.
+// A previous group ID goes to the group holding most of its members, ties go to the group whose lowest member ID is lower.
+// Groups that don't get a previous ID get a new one.
+func keepVariantGroupIDs(groups [][]VariantCandidate, previous map[string]string) []string {
+	type claim struct {
+		group   int
+		id      string
+		members int
+	}
+
+	var claims []claim
+	for i, group := range groups {
+		counts := make(map[string]int)
+		for _, member := range group {
+			if id := previous[member.ID]; id != "" {
+				counts[id]++
+			}
+		}
+		for id, count := range counts {
+			claims = append(claims, claim{group: i, id: id, members: count})
+		}
+	}
+	sort.Slice(claims, func(i, j int) bool {
+		if claims[i].members != claims[j].members {
+			return claims[i].members > claims[j].members
+		}
+		if claims[i].id != claims[j].id {
+			return claims[i].id < claims[j].id
+		}
+		return claims[i].group < claims[j].group
+	})
+
+	ids := make([]string, len(groups))
+	taken := make(map[string]bool)
+	for _, claim := range claims {
+		if ids[claim.group] == "" && !taken[claim.id] {
+			ids[claim.group] = claim.id
+			taken[claim.id] = true
+		}
+	}
+	for i, group := range groups {
+		if ids[i] == "" {
+			ids[i] = newVariantGroupID(group, taken)
+			taken[ids[i]] = true
+		}
+	}
+	return ids
+}
+
+// newVariantGroupID derives the ID of a new group from its members, which have to be sorted by ID.
+// A group that was split may have kept the ID its members had when it was created, so IDs in taken are skipped.
+func newVariantGroupID(members []VariantCandidate, taken map[string]bool) string {
+	ids := make([]string, 0, len(members))
+	for _, member := range members {
+		ids = append(ids, member.ID)
+	}
+	seed := strings.Join(ids, "\n")
+
+	for {
+		sum := sha1.Sum([]byte(seed))
+		id := hex.EncodeToString(sum[:8])
+		if !taken[id] {
+			return id
+		}
+		seed = id
+	}
+}
+
+// newVariantGroup builds the group of connected members, which have to be sorted by ID
+func newVariantGroup(id string, members []VariantCandidate) VariantGroup {
+	best := members[0]
+	for _, member := range members {
+		if betterVariant(member, best) {
+			best = member
+		}
+	}
+
+	group := VariantGroup{
+		ID:      id,
+		Best:    best.ID,
+		Members: make([]PHashEntry, 0, len(members)),
+	}
+	for _, member := range members {
+		group.Members = append(group.Members, PHashEntry{
+			ID:       member.ID,
+			Hash:     member.Hash,
+			Distance: HammingDistance(member.Hash, best.Hash),
+		})
+	}
+	return group
+}
+
+/* AttachVariants adds newly found variants to the existing groups, merging groups that become connected
+ * Groups that aren't linked to are kept as they are, a merged group keeps the ID of the group with the most members
+ * @param groups The existing groups, sorted by ID
+ * @param candidates The known images by ID, members missing from it only keep their hash
+ * @param links Pairs of IDs of images that are variants of each other
+ * @return All groups sorted by ID, and the groups that were created or changed
+ */
+func AttachVariants(groups []VariantGroup, candidates map[string]VariantCandidate, links [][2]string) ([]VariantGroup, []VariantGroup) {
+	groupOf := make(map[string]int)
+	for i, group := range groups {
+		for _, member := range group.Members {
+			groupOf[member.ID] = i
+		}
+	}
+
+	// the linked images and every member of their groups make up the affected part of the graph
+	touched := make(map[int]bool)
+	affected := make(map[string]VariantCandidate)
+	for _, link := range links {
+		for _, id := range link {
+			if i, ok := groupOf[id]; ok {
+				touched[i] = true
+				continue
+			}
+			affected[id] = candidates[id]
+		}
+	}
+	for i := range touched {
+		for _, member := range groups[i].Members {
+			candidate, ok := candidates[member.ID]
+			if !ok {
+				candidate = VariantCandidate{Hash: member.Hash}
+			}
+			candidate.ID = member.ID
+			affected[member.ID] = candidate
+		}
+	}
+
+	sorted := make([]VariantCandidate, 0, len(affected))
+	for id, candidate := range affected {
+		candidate.ID = id
+		sorted = append(sorted, candidate)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].ID < sorted[j].ID
+	})
+	positions := make(map[string]int, len(sorted))
+	for i, candidate := range sorted {
+		positions[candidate.ID] = i
+	}
+
+	components := newUnionFind(len(sorted))
+	for i := range touched {
+		first := positions[groups[i].Members[0].ID]
+		for _, member := range groups[i].Members[1:] {
+			components.union(first, positions[member.ID])
+		}
+	}
+	for _, link := range links {
+		components.union(positions[link[0]], positions[link[1]])
+	}
+
+	members := make(map[int][]VariantCandidate)
+	for i, candidate := range sorted {
+		root := components.find(i)
+		members[root] = append(members[root], candidate)
+	}
+
+	// merged groups keep the ID of the group with the most members, so the fewest images change their group
+	survivors := make(map[int]int)
+	for i := range touched {
+		root := components.find(positions[groups[i].Members[0].ID])
+		survivor, ok := survivors[root]
+		if !ok || len(groups[i].Members) > len(groups[survivor].Members) ||
+			(len(groups[i].Members) == len(groups[survivor].Members) && groups[i].ID < groups[survivor].ID) {
+			survivors[root] = i
+		}
+	}
+
+	taken := make(map[string]bool, len(groups))
+	for _, group := range groups {
+		taken[group.ID] = true
+	}
+
+	var changed []VariantGroup
+	for i := range sorted {
+		if components.find(i) != i || len(members[i]) < 2 {
+			continue
+		}
+		var id string
+		if survivor, ok := survivors[i]; ok {
+			id = groups[survivor].ID
+		} else {
+			id = newVariantGroupID(members[i], taken)
+			taken[id] = true
+		}
+		changed = append(changed, newVariantGroup(id, members[i]))
+	}
+
+	updated := make([]VariantGroup, 0, len(groups)-len(touched)+len(changed))
+	for i, group := range groups {
+		if !touched[i] {
+			updated = append(updated, group)
+		}
+	}
+	updated = append(updated, changed...)
+	sort.Slice(updated, func(i, j int) bool {
+		return updated[i].ID < updated[j].ID
+	})
+
+	return updated, changed
+}
+
+// variantGroupsFromImageGroups converts groups stored before they had an ID and a best member
+func variantGroupsFromImageGroups(imageGroups [][]PHashEntry) []VariantGroup {
+	groups := make([]VariantGroup, 0, len(imageGroups))
+	for _, imageGroup := range imageGroups {
+		if len(imageGroup) == 0 {
+			continue
+		}
+
+		members := make([]PHashEntry, len(imageGroup))
+		copy(members, imageGroup)
+		sort.Slice(members, func(i, j int) bool {
+			return members[i].ID < members[j].ID
+		})
+
+		groups = append(groups, VariantGroup{
+			ID:      members[0].ID,
+			Best:    members[0].ID,
+			Members: members,
+		})
+	}
+	return groups
+}
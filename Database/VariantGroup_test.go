@@ -0,0 +1,244 @@
+package Database
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestGroupVariantsFollowsChains(t *testing.T) {
+	// a and c are 10 bits apart, but both are within 5 bits of b
+	candidates := []VariantCandidate{
+		{ID: "a", Hash: 0xFFFF000000000000},
+		{ID: "b", Hash: 0xFFFF00000000001F},
+		{ID: "c", Hash: 0xFFFF0000000003FF},
+		{ID: "d", Hash: 0x00000000FFFFFFFF},
+	}
+
+	groups := GroupVariants(candidates, nil, 9)
+	if len(groups) != 1 {
+		t.Fatalf("expected a single group, got %+v", groups)
+	}
+	if members := memberIDs(groups[0]); !reflect.DeepEqual(members, []string{"a", "b", "c"}) {
+		t.Errorf("expected a group with members a, b and c, got %v", members)
+	}
+}
+
+func TestGroupVariantsMergesChainsFromBothEnds(t *testing.T) {
+	// c and d are only connected through e, which comes last in ID order
+	candidates := []VariantCandidate{
+		{ID: "c", Hash: 0x00000000000000FF},
+		{ID: "d", Hash: 0x000000000000FF00},
+		{ID: "e", Hash: 0x0000000000000FF0},
+	}
+
+	groups := GroupVariants(candidates, nil, 8)
+	if len(groups) != 1 || len(groups[0].Members) != 3 {
+		t.Fatalf("expected a single group of three, got %+v", groups)
+	}
+}
+
+func TestGroupVariantsPicksBestMember(t *testing.T) {
+	candidates := []VariantCandidate{
+		{ID: "a", Hash: 0xF0, Width: 800, Height: 600, Size: 1000},
+		{ID: "b", Hash: 0xF1, Width: 1920, Height: 1080, Size: 500},
+		{ID: "c", Hash: 0xF3, Width: 1920, Height: 1080, Size: 900},
+		{ID: "d", Hash: 0xF7},
+	}
+
+	groups := GroupVariants(candidates, nil, 9)
+	if len(groups) != 1 {
+		t.Fatalf("expected a single group, got %+v", groups)
+	}
+	if groups[0].Best != "c" {
+		t.Errorf("expected c to be the best member, got %s", groups[0].Best)
+	}
+	for _, member := range groups[0].Members {
+		if member.Distance != HammingDistance(member.Hash, 0xF3) {
+			t.Errorf("member %s has distance %d to the best member", member.ID, member.Distance)
+		}
+	}
+}
+
+func TestGroupVariantsSkipsLoneAndUnhashedImages(t *testing.T) {
+	candidates := []VariantCandidate{
+		{ID: "a", Hash: 0},
+		{ID: "b", Hash: 0},
+		{ID: "c", Hash: 0xFFFFFFFFFFFFFFFF},
+	}
+
+	if groups := GroupVariants(candidates, nil, 9); len(groups) != 0 {
+		t.Errorf("expected no groups, got %+v", groups)
+	}
+}
+
+func TestGroupVariantsIsOrderIndependent(t *testing.T) {
+	hashes := syntheticHashes(2000)
+	candidates := make([]VariantCandidate, len(hashes))
+	for i, hash := range hashes {
+		candidates[i] = VariantCandidate{ID: strconv.Itoa(i), Hash: hash, Width: i % 7, Height: i % 5}
+	}
+
+	previous := map[string]string{"0": "kept", "1": "kept"}
+	expected := GroupVariants(candidates, previous, 9)
+	if len(expected) == 0 {
+		t.Fatal("expected the synthetic hashes to contain variants")
+	}
+
+	random := rand.New(rand.NewSource(2))
+	for round := 0; round < 5; round++ {
+		random.Shuffle(len(candidates), func(i, j int) {
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		})
+
+		if groups := GroupVariants(candidates, previous, 9); !reflect.DeepEqual(groups, expected) {
+			t.Fatalf("groups changed after shuffling in round %d", round)
+		}
+	}
+}
+
+func TestAttachVariantsMergesGroups(t *testing.T) {
+	candidates := map[string]VariantCandidate{
+		"a": {ID: "a", Hash: 0x01},
+		"b": {ID: "b", Hash: 0x03},
+		"x": {ID: "x", Hash: 0xFF00000000000000},
+		"y": {ID: "y", Hash: 0xFF00000000000001},
+		"m": {ID: "m", Hash: 0x07, Width: 100, Height: 100},
+	}
+	groups := []VariantGroup{
+		newVariantGroup("g1", []VariantCandidate{candidates["a"], candidates["b"]}),
+		newVariantGroup("g2", []VariantCandidate{candidates["x"], candidates["y"]}),
+	}
+
+	// m is linked to both a and x, which connects both groups
+	updated, changed := AttachVariants(groups, candidates, [][2]string{{"b", "m"}, {"x", "m"}})
+	if len(updated) != 1 || len(changed) != 1 {
+		t.Fatalf("expected the groups to be merged into one, got %+v", updated)
+	}
+	if updated[0].ID != "g1" || updated[0].Best != "m" || len(updated[0].Members) != 5 {
+		t.Errorf("expected group g1 with best member m and five members, got %+v", updated[0])
+	}
+}
+
+func TestAttachVariantsKeepsUnlinkedGroups(t *testing.T) {
+	candidates := map[string]VariantCandidate{
+		"a": {ID: "a", Hash: 0x01},
+		"b": {ID: "b", Hash: 0x03},
+		"c": {ID: "c", Hash: 0xFF00000000000000},
+		"d": {ID: "d", Hash: 0xFF00000000000001},
+	}
+	groups := []VariantGroup{newVariantGroup("g1", []VariantCandidate{candidates["c"], candidates["d"]})}
+
+	updated, changed := AttachVariants(groups, candidates, [][2]string{{"a", "b"}})
+	if len(updated) != 2 || len(changed) != 1 {
+		t.Fatalf("expected a new group next to g1, got %+v", updated)
+	}
+	if changed[0].ID == "g1" || !reflect.DeepEqual(memberIDs(changed[0]), []string{"a", "b"}) {
+		t.Errorf("expected only a new group of a and b to change, got %+v", changed)
+	}
+	for _, group := range updated {
+		if group.ID == "g1" && !reflect.DeepEqual(group, groups[0]) {
+			t.Errorf("expected group g1 to be kept as it was, got %+v", group)
+		}
+	}
+}
+
+func TestAttachVariantsMatchesGroupVariants(t *testing.T) {
+	hashes := syntheticHashes(2000)
+	all := make([]VariantCandidate, len(hashes))
+	for i, hash := range hashes {
+		all[i] = VariantCandidate{ID: strconv.Itoa(i), Hash: hash, Width: i % 7, Height: i % 5}
+	}
+
+	// images arrive one by one and are linked to the images before them, like process mode does
+	var groups []VariantGroup
+	known := make(map[string]VariantCandidate)
+	index := NewPHashIndex()
+	for _, candidate := range all {
+		var links [][2]string
+		for _, other := range index.Search(candidate.Hash, 9) {
+			links = append(links, [2]string{other.ID, candidate.ID})
+		}
+		known[candidate.ID] = candidate
+		index.Insert(candidate.ID, candidate.Hash)
+
+		if len(links) > 0 {
+			groups, _ = AttachVariants(groups, known, links)
+		}
+	}
+
+	if expected := GroupVariants(all, nil, 9); !reflect.DeepEqual(sortedMemberIDs(groups), sortedMemberIDs(expected)) {
+		t.Errorf("attaching images one by one resulted in %d groups, grouping all at once in %d", len(groups), len(expected))
+	}
+
+	// regrouping everything keeps the IDs the groups got while attaching
+	previous := make(map[string]string)
+	for _, group := range groups {
+		for _, member := range group.Members {
+			previous[member.ID] = group.ID
+		}
+	}
+	if regrouped := GroupVariants(all, previous, 9); !reflect.DeepEqual(regrouped, groups) {
+		t.Error("regrouping changed the groups that were built by attaching")
+	}
+}
+
+func TestGroupVariantsKeepsIDOfLargerPart(t *testing.T) {
+	// a, c and d were grouped through an image that was removed since, c is now only close to e of another group
+	candidates := []VariantCandidate{
+		{ID: "a", Hash: 0x01},
+		{ID: "c", Hash: 0xFFFF000000000000},
+		{ID: "d", Hash: 0x03},
+		{ID: "e", Hash: 0xFFFF000000000001},
+	}
+	previous := map[string]string{"a": "g1", "c": "g1", "d": "g1", "e": "g2"}
+
+	groups := GroupVariants(candidates, previous, 9)
+	if len(groups) != 2 {
+		t.Fatalf("expected two groups, got %+v", groups)
+	}
+
+	byID := make(map[string][]string)
+	for _, group := range groups {
+		byID[group.ID] = memberIDs(group)
+	}
+	if !reflect.DeepEqual(byID["g1"], []string{"a", "d"}) {
+		t.Errorf("expected a and d to keep group g1, got %v", byID)
+	}
+	if !reflect.DeepEqual(byID["g2"], []string{"c", "e"}) {
+		t.Errorf("expected c to join group g2 of e, got %v", byID)
+	}
+}
+
+func TestNewVariantGroupIDSkipsTakenIDs(t *testing.T) {
+	pair := []VariantCandidate{{ID: "a", Hash: 0x01}, {ID: "b", Hash: 0x03}}
+	id := newVariantGroupID(pair, nil)
+	if id == "" || newVariantGroupID(pair, nil) != id {
+		t.Fatalf("expected a stable ID, got %q", id)
+	}
+	if other := newVariantGroupID(pair, map[string]bool{id: true}); other == id {
+		t.Errorf("expected a different ID once %s is taken", id)
+	}
+}
+
+func memberIDs(group VariantGroup) []string {
+	ids := make([]string, 0, len(group.Members))
+	for _, member := range group.Members {
+		ids = append(ids, member.ID)
+	}
+	return ids
+}
+
+// sortedMemberIDs returns the members of all groups independent of their IDs
+func sortedMemberIDs(groups []VariantGroup) [][]string {
+	members := make([][]string, 0, len(groups))
+	for _, group := range groups {
+		members = append(members, memberIDs(group))
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i][0] < members[j][0]
+	})
+	return members
+}
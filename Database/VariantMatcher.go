@@ -0,0 +1,639 @@
+package Database
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/go-redis/redis/v8"
+	"sort"
+	"sync"
+	"time"
+)
+
+// variantGroupsKey is a hash of the variant groups by their ID, every group is stored as a payload envelope
+const variantGroupsKey = "paktum:variant_groups"
+
+// variantGroupMembersKey is a hash of the ID of the variant group by the ID of its members, images without a group aren't in it
+const variantGroupMembersKey = "paktum:variant_group_members"
+
+// legacyVariantGroupsKey held all variant groups in a single payload envelope before they were stored per group
+const legacyVariantGroupsKey = "paktum:image_alts"
+
+// variantGroupsVersionKey is incremented on every change of the variant groups, so readers know when to refetch them
+const variantGroupsVersionKey = "paktum:image_alts_version"
+
+// phashIndexKey is a list of JSON-encoded VariantCandidate of all indexed images, new images are appended to it
+const phashIndexKey = "paktum:phashes"
+
+// phashIndexGenerationKey is incremented whenever cleanup mode rebuilds the pHash index, so matchers know to reload it
+const phashIndexGenerationKey = "paktum:phashes_generation"
+
+// variantGroupsLockKey is held while the variant groups or the pHash index are changed, see lockVariantGroups
+const variantGroupsLockKey = "paktum:variant_groups_lock"
+
+// variantGroupsLockTimeout is how long the lock is held at most, in case its holder dies, and how long to wait for it.
+// It is only held while a few images are grouped, cleanup mode rebuilds the groups without it and only swaps them in under it.
+const variantGroupsLockTimeout = time.Minute
+
+// rebuildSuffix is appended to the keys that a rebuild is written to, followed by the ID of the rebuild, before they replace the live keys
+const rebuildSuffix = ":rebuild:"
+
+// unlockScript only deletes the lock if it is still held by the token, so a lock that expired and was taken by someone else is kept
+var unlockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// swapRebuildScript replaces the live keys in KEYS[2..4] with their rebuilds in KEYS[5..7] if the lock in KEYS[1] is still held by ARGV[1].
+// A rebuild without any entries doesn't exist, and empties its live key instead.
+// It also removes the legacy groups in KEYS[8] and increments the generation of the index and the version of the groups in KEYS[9] and KEYS[10].
+var swapRebuildScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return redis.error_reply("lost the variant groups lock while swapping in the rebuilt groups")
+end
+for i = 2, 4 do
+	if redis.call("EXISTS", KEYS[i + 3]) == 1 then
+		redis.call("RENAME", KEYS[i + 3], KEYS[i])
+	else
+		redis.call("DEL", KEYS[i])
+	end
+end
+redis.call("DEL", KEYS[8])
+redis.call("INCR", KEYS[9])
+redis.call("INCR", KEYS[10])
+return 1
+`)
+
+// newToken returns a random token that identifies a lock holder or a rebuild
+func newToken() string {
+	random := make([]byte, 16)
+	_, _ = rand.Read(random)
+	return hex.EncodeToString(random)
+}
+
+// lockVariantGroups waits until no other process changes the variant groups or the pHash index and takes the lock.
+// Process workers hold it from reading the index until their images are appended and grouped, so no two workers miss each other's images,
+// and cleanup mode holds it while it replaces the index, so no images are appended to the one being replaced.
+// It returns the token to unlock with.
+func lockVariantGroups() (string, error) {
+	token := newToken()
+
+	deadline := time.Now().Add(variantGroupsLockTimeout)
+	for {
+		locked, err := GetRedis().SetNX(context.Background(), variantGroupsLockKey, token, variantGroupsLockTimeout).Result()
+		if err != nil {
+			return "", err
+		}
+		if locked {
+			return token, nil
+		}
+		if time.Now().After(deadline) {
+			return "", errors.New("timed out waiting for the variant groups lock")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// unlockVariantGroups releases the lock taken with token, a failure is harmless since the lock expires on its own
+func unlockVariantGroups(token string) {
+	_ = unlockScript.Run(context.Background(), GetRedis(), []string{variantGroupsLockKey}, token).Err()
+}
+
+// getVariantGroups returns the stored groups with the given IDs sorted by ID, unknown IDs are skipped
+func getVariantGroups(ids []string) ([]VariantGroup, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	payloads, err := GetRedis().HMGet(context.Background(), variantGroupsKey, ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make([]VariantGroup, 0, len(payloads))
+	for _, payload := range payloads {
+		encoded, ok := payload.(string)
+		if !ok {
+			continue
+		}
+		group, err := DecodeVariantGroup([]byte(encoded))
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].ID < groups[j].ID
+	})
+	return groups, nil
+}
+
+// storeVariantGroups queues writing groups and the group of their members into pipe, all keys get the given suffix
+func storeVariantGroups(pipe redis.Pipeliner, groups []VariantGroup, suffix string) error {
+	for i := 0; i < len(groups); i += 1000 {
+		end := i + 1000
+		if end > len(groups) {
+			end = len(groups)
+		}
+
+		payloads := make(map[string]interface{}, end-i)
+		members := make(map[string]interface{})
+		for _, group := range groups[i:end] {
+			payload, err := EncodeVariantGroup(group)
+			if err != nil {
+				return err
+			}
+			payloads[group.ID] = payload
+			for _, member := range group.Members {
+				members[member.ID] = group.ID
+			}
+		}
+		pipe.HSet(context.Background(), variantGroupsKey+suffix, payloads)
+		pipe.HSet(context.Background(), variantGroupMembersKey+suffix, members)
+	}
+	return nil
+}
+
+// PHashIndexPosition is how far the persisted pHash index reached at some point, see GetPHashIndexPosition
+type PHashIndexPosition struct {
+	generation string
+	length     int64
+}
+
+/* GetPHashIndexPosition returns how far the persisted pHash index reaches right now
+ * Images appended to it later can be found from the position, see RebuildVariantGroups
+ * @return The position, and a possible error
+ */
+func GetPHashIndexPosition() (PHashIndexPosition, error) {
+	var generation *redis.StringCmd
+	var length *redis.IntCmd
+	_, err := GetRedis().TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		generation = pipe.Get(context.Background(), phashIndexGenerationKey)
+		length = pipe.LLen(context.Background(), phashIndexKey)
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return PHashIndexPosition{}, err
+	}
+
+	return PHashIndexPosition{generation: generation.Val(), length: length.Val()}, nil
+}
+
+/* RebuildVariantGroups groups all images from scratch and replaces the variant groups and the pHash index with the result
+ * The groups are built and written without holding the lock, so process workers aren't blocked while cleanup runs.
+ * Only swapping them in happens under the lock, along with adding the images that process mode indexed since position.
+ * The groups keep their IDs, see GroupVariants.
+ * @param candidates All indexed images, read after position was taken
+ * @param position The position of the pHash index before the candidates were read
+ * @param previous The group ID of images by image ID as stored on their documents, the stored groups take precedence over it
+ * @param maxDistance The largest Hamming distance of images that are considered variants
+ * @return The new groups sorted by ID, and a possible error
+ */
+func RebuildVariantGroups(candidates []VariantCandidate, position PHashIndexPosition, previous map[string]string, maxDistance int) ([]VariantGroup, error) {
+	members, err := GetRedis().HGetAll(context.Background(), variantGroupMembersKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	groupIDs := make(map[string]string, len(previous)+len(members))
+	for id, groupID := range previous {
+		groupIDs[id] = groupID
+	}
+	for id, groupID := range members {
+		groupIDs[id] = groupID
+	}
+	groups := GroupVariants(candidates, groupIDs, maxDistance)
+
+	known := make(map[string]VariantCandidate, len(candidates))
+	index := NewPHashIndex()
+	entries := make([]interface{}, 0, len(candidates))
+	for _, candidate := range candidates {
+		known[candidate.ID] = candidate
+		if candidate.Hash == 0 {
+			continue
+		}
+		index.Insert(candidate.ID, candidate.Hash)
+		entry, err := json.Marshal(candidate)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	// the rebuild is written next to the live keys and renamed over them at once, so readers never see a partial index
+	rebuild := rebuildSuffix + newToken()
+	rebuildKeys := []string{phashIndexKey + rebuild, variantGroupsKey + rebuild, variantGroupMembersKey + rebuild}
+	defer GetRedis().Del(context.Background(), rebuildKeys...)
+	err = writeRebuild(rebuild, entries, groups, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := lockVariantGroups()
+	if err != nil {
+		return nil, err
+	}
+	defer unlockVariantGroups(token)
+
+	// nobody can append to the index while we hold the lock, so everything after the position is all we missed
+	generation, err := GetRedis().Get(context.Background(), phashIndexGenerationKey).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	if generation != position.generation {
+		return nil, errors.New("the pHash index was rebuilt by another cleanup in the meantime")
+	}
+	appended, err := GetRedis().LRange(context.Background(), phashIndexKey, position.length, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	replayed, err := replayPHashIndex(known, appended)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(replayed) > 0 {
+		var changed []VariantGroup
+		var removed []string
+		groups, changed, removed = attachReplayed(groups, index, known, replayed, maxDistance)
+
+		entries = entries[:0]
+		for _, candidate := range replayed {
+			entry, err := json.Marshal(candidate)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+		err = writeRebuild(rebuild, entries, changed, removed)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	keys := append([]string{variantGroupsLockKey, phashIndexKey, variantGroupsKey, variantGroupMembersKey}, rebuildKeys...)
+	keys = append(keys, legacyVariantGroupsKey, phashIndexGenerationKey, variantGroupsVersionKey)
+	err = swapRebuildScript.Run(context.Background(), GetRedis(), keys, token).Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return groups, nil
+}
+
+// writeRebuild appends index entries to the rebuilt pHash index and stores groups in the rebuilt groups, removing the groups with the given IDs
+func writeRebuild(rebuild string, entries []interface{}, groups []VariantGroup, removed []string) error {
+	_, err := GetRedis().Pipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		for i := 0; i < len(entries); i += 1000 {
+			end := i + 1000
+			if end > len(entries) {
+				end = len(entries)
+			}
+			pipe.RPush(context.Background(), phashIndexKey+rebuild, entries[i:end]...)
+		}
+		if len(removed) > 0 {
+			pipe.HDel(context.Background(), variantGroupsKey+rebuild, removed...)
+		}
+		return storeVariantGroups(pipe, groups, rebuild)
+	})
+	return err
+}
+
+// replayPHashIndex returns the images of JSON-encoded pHash index entries that aren't known yet, and adds them to known
+func replayPHashIndex(known map[string]VariantCandidate, entries []string) ([]VariantCandidate, error) {
+	var replayed []VariantCandidate
+	for _, entry := range entries {
+		var candidate VariantCandidate
+		err := json.Unmarshal([]byte(entry), &candidate)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := known[candidate.ID]; ok {
+			continue
+		}
+		known[candidate.ID] = candidate
+		replayed = append(replayed, candidate)
+	}
+	return replayed, nil
+}
+
+/* attachReplayed adds images that were indexed while the groups were rebuilt to the rebuilt groups, like process mode would have
+ * @param groups The rebuilt groups sorted by ID
+ * @param index The pHash index of the images the groups were built from, the replayed images are added to it
+ * @param known All images by ID, including the replayed ones
+ * @param replayed The images indexed since the rebuild started
+ * @param maxDistance The largest Hamming distance of images that are considered variants
+ * @return All groups sorted by ID, the groups that were created or changed, and the IDs of the groups that were merged into others
+ */
+func attachReplayed(groups []VariantGroup, index *PHashIndex, known map[string]VariantCandidate, replayed []VariantCandidate, maxDistance int) ([]VariantGroup, []VariantGroup, []string) {
+	var links [][2]string
+	for _, candidate := range replayed {
+		if candidate.Hash == 0 {
+			continue
+		}
+		for _, other := range index.Search(candidate.Hash, maxDistance) {
+			links = append(links, [2]string{other.ID, candidate.ID})
+		}
+		index.Insert(candidate.ID, candidate.Hash)
+	}
+	if len(links) == 0 {
+		return groups, nil, nil
+	}
+
+	groupOf := make(map[string]int)
+	for i, group := range groups {
+		for _, member := range group.Members {
+			groupOf[member.ID] = i
+		}
+	}
+	touched := make(map[int]bool)
+	for _, link := range links {
+		for _, id := range link {
+			if i, ok := groupOf[id]; ok {
+				touched[i] = true
+			}
+		}
+	}
+	var touchedGroups []VariantGroup
+	for i, group := range groups {
+		if touched[i] {
+			touchedGroups = append(touchedGroups, group)
+		}
+	}
+
+	_, changed := AttachVariants(touchedGroups, known, links)
+
+	kept := make(map[string]bool, len(changed))
+	for _, group := range changed {
+		kept[group.ID] = true
+	}
+	var removed []string
+	updated := make([]VariantGroup, 0, len(groups)-len(touchedGroups)+len(changed))
+	for i, group := range groups {
+		if !touched[i] {
+			updated = append(updated, group)
+		} else if !kept[group.ID] {
+			removed = append(removed, group.ID)
+		}
+	}
+	updated = append(updated, changed...)
+	sort.Slice(updated, func(i, j int) bool {
+		return updated[i].ID < updated[j].ID
+	})
+
+	return updated, changed, removed
+}
+
+/* ConvertLegacyVariantGroups moves the variant groups from the single payload written by older builds into the per group keys
+ * Nothing is changed if there are no legacy groups
+ */
+func ConvertLegacyVariantGroups() error {
+	token, err := lockVariantGroups()
+	if err != nil {
+		return err
+	}
+	defer unlockVariantGroups(token)
+
+	payload, err := GetRedis().Get(context.Background(), legacyVariantGroupsKey).Bytes()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	groups, err := DecodeVariantGroups(payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = GetRedis().TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		pipe.Del(context.Background(), variantGroupsKey, variantGroupMembersKey, legacyVariantGroupsKey)
+		err := storeVariantGroups(pipe, groups, "")
+		pipe.Incr(context.Background(), variantGroupsVersionKey)
+		return err
+	})
+	return err
+}
+
+// VariantMatcher attaches newly indexed images to the variant groups of the images they are similar to.
+// It keeps a copy of the persisted pHash index in memory and catches up with the images added by other processes before every match.
+type VariantMatcher struct {
+	mutex       sync.Mutex
+	maxDistance int
+	index       *PHashIndex
+	candidates  map[string]VariantCandidate
+	// generation and offset are the generation of the persisted index and how much of it has been read
+	generation string
+	offset     int64
+}
+
+func NewVariantMatcher(maxDistance int) *VariantMatcher {
+	return &VariantMatcher{
+		maxDistance: maxDistance,
+		index:       NewPHashIndex(),
+		candidates:  make(map[string]VariantCandidate),
+	}
+}
+
+// sync reads the images that were added to the persisted index since the last sync, or all of them if it was rebuilt
+func (m *VariantMatcher) sync() error {
+	var generation *redis.StringCmd
+	var entries *redis.StringSliceCmd
+	_, err := GetRedis().TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		generation = pipe.Get(context.Background(), phashIndexGenerationKey)
+		entries = pipe.LRange(context.Background(), phashIndexKey, m.offset, -1)
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	if generation.Val() != m.generation {
+		m.generation = generation.Val()
+		m.index = NewPHashIndex()
+		m.candidates = make(map[string]VariantCandidate)
+		m.offset = 0
+		// the entries were read from the old offset, so the rebuilt index has to be read from the start
+		entries = GetRedis().LRange(context.Background(), phashIndexKey, 0, -1)
+		if entries.Err() != nil {
+			return entries.Err()
+		}
+	}
+
+	for _, entry := range entries.Val() {
+		var candidate VariantCandidate
+		err := json.Unmarshal([]byte(entry), &candidate)
+		if err != nil {
+			return err
+		}
+		m.insert(candidate)
+	}
+	m.offset += int64(len(entries.Val()))
+
+	return nil
+}
+
+func (m *VariantMatcher) insert(candidate VariantCandidate) {
+	if _, ok := m.candidates[candidate.ID]; ok {
+		return
+	}
+	m.candidates[candidate.ID] = candidate
+	m.index.Insert(candidate.ID, candidate.Hash)
+}
+
+/* Attach adds images to the pHash index and to the variant groups of the images within the variant distance
+ * Groups that become connected through an image are merged, only the affected groups are read and written
+ * @param candidates The newly indexed images
+ * @return The groups that were created or changed, and a possible error
+ */
+func (m *VariantMatcher) Attach(candidates []VariantCandidate) ([]VariantGroup, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	token, err := lockVariantGroups()
+	if err != nil {
+		return nil, err
+	}
+	defer unlockVariantGroups(token)
+
+	err = m.sync()
+	if err != nil {
+		return nil, err
+	}
+
+	// the new images are only added to the matcher once they are persisted, so a failed attach is retried with them.
+	// Until then they are kept in their own index, so images of the same batch are linked to each other
+	pending := NewPHashIndex()
+	known := make(map[string]VariantCandidate)
+	var links [][2]string
+	var entries []interface{}
+	for _, candidate := range candidates {
+		if _, ok := m.candidates[candidate.ID]; ok || candidate.Hash == 0 {
+			continue
+		}
+		if _, ok := known[candidate.ID]; ok {
+			continue
+		}
+
+		for _, other := range m.index.Search(candidate.Hash, m.maxDistance) {
+			links = append(links, [2]string{other.ID, candidate.ID})
+			known[other.ID] = m.candidates[other.ID]
+		}
+		for _, other := range pending.Search(candidate.Hash, m.maxDistance) {
+			links = append(links, [2]string{other.ID, candidate.ID})
+		}
+		pending.Insert(candidate.ID, candidate.Hash)
+		known[candidate.ID] = candidate
+
+		entry, err := json.Marshal(candidate)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	var changed []VariantGroup
+	var removed []string
+	if len(links) > 0 {
+		changed, removed, err = m.groupLinks(links, known)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the images and their groups are written at once, so the images are never in the index without being grouped
+	_, err = GetRedis().TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		pipe.RPush(context.Background(), phashIndexKey, entries...)
+		if len(removed) > 0 {
+			pipe.HDel(context.Background(), variantGroupsKey, removed...)
+		}
+		err := storeVariantGroups(pipe, changed, "")
+		if len(changed) > 0 {
+			pipe.Incr(context.Background(), variantGroupsVersionKey)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// our own entries are skipped as known by the next sync
+	for _, candidate := range candidates {
+		if _, ok := known[candidate.ID]; ok && candidate.Hash != 0 {
+			m.insert(candidate)
+		}
+	}
+
+	return changed, nil
+}
+
+// groupLinks reads the stored groups of linked images and merges them along the links.
+// known has to hold every linked image that isn't in the matcher yet.
+// It returns the groups that were created or changed, and the IDs of the groups that were merged into others.
+func (m *VariantMatcher) groupLinks(links [][2]string, known map[string]VariantCandidate) ([]VariantGroup, []string, error) {
+	var linked []string
+	for _, link := range links {
+		linked = append(linked, link[0], link[1])
+	}
+	groupIDs, err := GetRedis().HMGet(context.Background(), variantGroupMembersKey, linked...).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+	var touchedIDs []string
+	seen := make(map[string]bool)
+	for _, groupID := range groupIDs {
+		if id, ok := groupID.(string); ok && !seen[id] {
+			seen[id] = true
+			touchedIDs = append(touchedIDs, id)
+		}
+	}
+	groups, err := getVariantGroups(touchedIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, group := range groups {
+		for _, member := range group.Members {
+			if candidate, ok := m.candidates[member.ID]; ok {
+				known[member.ID] = candidate
+			}
+		}
+	}
+	_, changed := AttachVariants(groups, known, links)
+
+	// merged groups are gone, their members were moved to the group that kept its ID
+	kept := make(map[string]bool, len(changed))
+	for _, group := range changed {
+		kept[group.ID] = true
+	}
+	var removed []string
+	for _, group := range groups {
+		if !kept[group.ID] {
+			removed = append(removed, group.ID)
+		}
+	}
+
+	return changed, removed, nil
+}
+
+/* Search returns the indexed images within maxDistance of a pHash, including the image with the pHash itself
+ * @param hash The pHash to search for
+ * @param maxDistance The largest Hamming distance of the images to return
+ * @return The images along with their distance, and a possible error
+ */
+func (m *VariantMatcher) Search(hash uint64, maxDistance int) ([]PHashEntry, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	err := m.sync()
+	if err != nil {
+		return nil, err
+	}
+	return m.index.Search(hash, maxDistance), nil
+}
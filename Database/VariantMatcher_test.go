@@ -0,0 +1,72 @@
+package Database
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestReplayPHashIndexAddsMissingImages(t *testing.T) {
+	known := map[string]VariantCandidate{"a": {ID: "a", Hash: 1}, "b": {ID: "b", Hash: 2}}
+
+	var entries []string
+	for _, candidate := range []VariantCandidate{{ID: "b", Hash: 2}, {ID: "c", Hash: 0xF0E1D2C3B4A59687}, {ID: "c", Hash: 0xF0E1D2C3B4A59687}} {
+		entry, err := json.Marshal(candidate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, string(entry))
+	}
+
+	replayed, err := replayPHashIndex(known, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// images indexed while the documents were read are replayed once, the ones already read are skipped
+	expected := []VariantCandidate{{ID: "c", Hash: 0xF0E1D2C3B4A59687}}
+	if !reflect.DeepEqual(replayed, expected) {
+		t.Errorf("expected %+v, got %+v", expected, replayed)
+	}
+	if _, ok := known["c"]; !ok || len(known) != 3 {
+		t.Errorf("expected the replayed image to be known, got %+v", known)
+	}
+}
+
+func TestAttachReplayedMatchesGroupVariants(t *testing.T) {
+	all := []VariantCandidate{
+		{ID: "a", Hash: 0b0100, Width: 10, Height: 10},
+		{ID: "b", Hash: 0b0101},
+		{ID: "c", Hash: 0xFFFF000000000000},
+		{ID: "d", Hash: 0xFFFF000000000001},
+		{ID: "e", Hash: 0x0000FFFF0000FFFF},
+		// f merges the groups of a and c, g groups with e
+		{ID: "f", Hash: 0xFF00000000000000},
+		{ID: "g", Hash: 0x0000FFFF0000FFFE},
+	}
+	rebuilt, replayed := all[:5], all[5:]
+
+	known := make(map[string]VariantCandidate)
+	index := NewPHashIndex()
+	for _, candidate := range rebuilt {
+		known[candidate.ID] = candidate
+		index.Insert(candidate.ID, candidate.Hash)
+	}
+	for _, candidate := range replayed {
+		known[candidate.ID] = candidate
+	}
+
+	groups := GroupVariants(rebuilt, nil, 9)
+	updated, changed, removed := attachReplayed(groups, index, known, replayed, 9)
+
+	expected := GroupVariants(all, nil, 9)
+	if !reflect.DeepEqual(sortedMemberIDs(updated), sortedMemberIDs(expected)) {
+		t.Errorf("expected groups %v, got %v", sortedMemberIDs(expected), sortedMemberIDs(updated))
+	}
+	if len(changed) != 2 {
+		t.Errorf("expected the merged and the new group to change, got %v", sortedMemberIDs(changed))
+	}
+	if len(removed) != 1 {
+		t.Errorf("expected one group to be merged into another, got %v", removed)
+	}
+}
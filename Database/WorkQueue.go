@@ -0,0 +1,57 @@
+package Database
+
+import (
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// MetadataQueue is the queue scrape mode pushes image batches to, it is split into priority lanes by LaneQueue
+const MetadataQueue = "paktum:metadata_process"
+
+// WorkerHeartbeatTTL is how long a worker counts as alive after its last heartbeat.
+// Batches claimed by workers without a heartbeat are moved back into their queue by ReclaimStale.
+const WorkerHeartbeatTTL = time.Second * 30
+
+// ErrQueueEmpty is returned by WorkQueue.Claim if no batch arrived before the timeout
+var ErrQueueEmpty = errors.New("queue is empty")
+
+// WorkQueue transfers payloads from the producing modes to process mode.
+// Payloads are delivered at least once: a claimed payload is kept until it is acknowledged or requeued.
+type WorkQueue interface {
+	// Push appends a payload to the end of queue
+	Push(queue string, payload string) error
+	// Claim takes the next payload of queue and keeps it in the processing list of worker until it is acknowledged.
+	// It blocks for at most timeout while the queue is empty and returns ErrQueueEmpty afterwards.
+	Claim(ctx context.Context, queue string, worker string, timeout time.Duration) (string, error)
+	// TryClaim is Claim without blocking, it returns ErrQueueEmpty right away if queue is empty
+	TryClaim(queue string, worker string) (string, error)
+	// Ack removes a finished payload from the processing list of worker
+	Ack(queue string, worker string, payload string) error
+	// Requeue moves a claimed payload back to the front of its queue, so it is retried by the next free worker
+	Requeue(queue string, worker string, payload string) error
+	// Heartbeat marks worker as alive for WorkerHeartbeatTTL
+	Heartbeat(worker string) error
+	// ReclaimStale moves the payloads claimed by dead workers back into queue and returns their number
+	ReclaimStale(queue string) (int, error)
+}
+
+var workQueue WorkQueue
+
+func SetWorkQueue(queue WorkQueue) {
+	workQueue = queue
+}
+
+func GetWorkQueue() WorkQueue {
+	if workQueue == nil {
+		log.Fatal("Work queue not initialized")
+	}
+
+	return workQueue
+}
+
+// processingKey is the list holding the payloads a worker has claimed but not acknowledged yet
+func processingKey(queue string, worker string) string {
+	return queue + ":processing:" + worker
+}
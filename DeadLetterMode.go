@@ -0,0 +1,56 @@
+package main
+
+import (
+	"Paktum/Database"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// DeadLetterMode lists, retries or purges the images that process mode failed to index
+func DeadLetterMode(action string, ids []string) {
+	switch action {
+	case "list":
+		deadLetters, err := Database.GetDeadLetters()
+		if err != nil {
+			log.Fatal("Failed to get dead letters: ", err)
+		}
+
+		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer, "ID\tATTEMPTS\tFAILED AT\tFILE URL\tREASON")
+		for _, deadLetter := range deadLetters {
+			failedAt := time.Unix(deadLetter.Timestamp, 0).Format(time.RFC3339)
+			fmt.Fprintf(writer, "%s\t%d\t%s\t%s\t%s\n", deadLetter.ID, deadLetter.Attempts, failedAt, deadLetter.Image.FileURL, deadLetter.Reason)
+		}
+		writer.Flush()
+	case "retry":
+		retried, err := Database.RetryDeadLetters(ids)
+		if err != nil {
+			log.Error("Failed to retry dead letters: ", err)
+		}
+		log.Info("Sent ", retried, " dead letters back to process mode")
+	case "purge":
+		purged, err := Database.PurgeDeadLetters(ids)
+		if err != nil {
+			log.Error("Failed to purge dead letters: ", err)
+		}
+		log.Info("Purged ", purged, " dead letters")
+	default:
+		log.Fatal("Unknown dead letter action ", action, ", choose either 'list', 'retry' or 'purge'")
+	}
+}
+
+// parseDeadLetterIDs splits a comma separated list of dead letter IDs
+func parseDeadLetterIDs(list string) []string {
+	var ids []string
+	for _, id := range strings.Split(list, ",") {
+		id = strings.TrimSpace(id)
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
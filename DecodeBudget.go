@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+)
+
+// DecodeBudget limits the memory held by decoded images at once.
+// Decoding a large PNG takes several bytes per pixel, so the hashing workers reserve the estimated size before decoding.
+type DecodeBudget struct {
+	limit int64
+	used  int64
+	cond  *sync.Cond
+}
+
+// NewDecodeBudget returns a budget of limit bytes, a limit of 0 or less disables it
+func NewDecodeBudget(limit int64) *DecodeBudget {
+	return &DecodeBudget{
+		limit: limit,
+		cond:  sync.NewCond(&sync.Mutex{}),
+	}
+}
+
+// maxDecodePixels is the largest image that is decoded at all, so a tiny file claiming huge dimensions can't exhaust the memory
+const maxDecodePixels = 100 * 1000 * 1000
+
+// decodedImageSize estimates the memory of a decoded image, assuming 4 bytes per pixel
+func decodedImageSize(width int, height int) int64 {
+	return int64(width) * int64(height) * 4
+}
+
+// checkImageDimensions rejects images over maxDecodePixels before they are decoded
+func checkImageDimensions(width int, height int) error {
+	if int64(width)*int64(height) > maxDecodePixels {
+		return errors.New("image of " + strconv.Itoa(width) + "x" + strconv.Itoa(height) + " pixels is too large to decode")
+	}
+	return nil
+}
+
+// Acquire blocks until size bytes are available.
+// An image larger than the whole budget could never be decoded within it and is rejected right away.
+func (b *DecodeBudget) Acquire(size int64) error {
+	if b == nil || b.limit <= 0 {
+		return nil
+	}
+	if size > b.limit {
+		return errors.New("image needs " + strconv.FormatInt(size, 10) + " bytes to decode, more than the decode budget of " + strconv.FormatInt(b.limit, 10))
+	}
+
+	b.cond.L.Lock()
+	for b.used+size > b.limit {
+		b.cond.Wait()
+	}
+	b.used += size
+	b.cond.L.Unlock()
+	return nil
+}
+
+// Release returns size bytes acquired with Acquire
+func (b *DecodeBudget) Release(size int64) {
+	if b == nil || b.limit <= 0 {
+		return
+	}
+
+	b.cond.L.Lock()
+	b.used -= size
+	b.cond.L.Unlock()
+	b.cond.Broadcast()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDecodeBudgetBlocksWhenFull(t *testing.T) {
+	budget := NewDecodeBudget(100)
+	budget.Acquire(60)
+
+	acquired := make(chan bool)
+	go func() {
+		budget.Acquire(60)
+		acquired <- true
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("acquired more than the budget")
+	case <-time.After(time.Millisecond * 20):
+	}
+
+	budget.Release(60)
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("release didn't unblock the waiting acquire")
+	}
+}
+
+func TestDecodeBudgetRejectsOversizedImages(t *testing.T) {
+	budget := NewDecodeBudget(100)
+
+	if err := budget.Acquire(500); err == nil {
+		t.Fatal("expected an image larger than the budget to be rejected")
+	}
+	// the rejected image must not hold any of the budget
+	if err := budget.Acquire(100); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckImageDimensions(t *testing.T) {
+	if err := checkImageDimensions(4000, 3000); err != nil {
+		t.Error(err)
+	}
+	if err := checkImageDimensions(100000, 100000); err == nil {
+		t.Error("expected a 10 gigapixel image to be rejected")
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/getsentry/sentry-go"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"os"
+)
+
+// DefaultMaxFileSize is the largest file process mode downloads unless configured otherwise
+const DefaultMaxFileSize = 100 * 1024 * 1024
+
+var errEmptyResponse = errors.New("empty response")
+
+/* downloadImage streams url into imageDir under filename while hashing it
+ * The download is rejected if it's larger than maxSize, shorter than its Content-Length or doesn't match md5sum.
+ * The temporary file is removed if the download fails or ctx is cancelled.
+ * @param md5sum The expected hex MD5 of the file, it isn't verified if empty
+ * @param maxSize The maximum file size in bytes, 0 disables the limit
+ * @return A possible error and the size of the file in bytes
+ */
+func downloadImage(ctx context.Context, url string, imageDir string, filename string, md5sum string, maxSize int64) (error, int) {
+	temporaryImageFile, err := os.CreateTemp(imageDir, "temp-paktum-")
+	if err != nil {
+		log.Error("Failed to create file:", err.Error())
+		return err, 0
+	}
+	defer func() {
+		// both fail harmlessly once the file has been moved to its proper name
+		_ = temporaryImageFile.Close()
+		_ = os.Remove(temporaryImageFile.Name())
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err, 0
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Error("Failed to download image:", err.Error())
+		return err, 0
+	}
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+
+		if err != nil {
+			sentry.CaptureException(err)
+			log.Error("Failed to close body:", err.Error())
+		}
+	}(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		log.Error("Failed to download image, response code: ", resp.Status, " on url: ", url)
+		return fmt.Errorf("unexpected response code %s", resp.Status), 0
+	}
+
+	// a Content-Length of -1 means the length is unknown, the body is read until EOF then
+	log.Trace("CONTENT-LENGTH:", resp.ContentLength)
+	if resp.ContentLength == 0 {
+		log.Error("EMPTY RESPONSE, url: ", url)
+		return errEmptyResponse, 0
+	}
+	if maxSize > 0 && resp.ContentLength > maxSize {
+		return fmt.Errorf("file size %d exceeds the limit of %d bytes", resp.ContentLength, maxSize), 0
+	}
+
+	body := io.Reader(resp.Body)
+	if maxSize > 0 {
+		// one byte more than allowed is read to notice bodies that exceed the limit
+		body = io.LimitReader(resp.Body, maxSize+1)
+	}
+
+	hasher := md5.New()
+	written, err := io.Copy(io.MultiWriter(temporaryImageFile, hasher), body)
+	if err != nil {
+		log.Error("Failed to write data into image:", err.Error())
+		return err, 0
+	}
+	log.Trace("Downloaded image, size: ", written, " bytes")
+
+	if written == 0 {
+		log.Error("EMPTY RESPONSE, url: ", url)
+		return errEmptyResponse, 0
+	}
+	if maxSize > 0 && written > maxSize {
+		return fmt.Errorf("file size exceeds the limit of %d bytes", maxSize), 0
+	}
+	if resp.ContentLength > 0 && written != resp.ContentLength {
+		return fmt.Errorf("received %d of %d bytes", written, resp.ContentLength), 0
+	}
+	if downloadedMD5 := hex.EncodeToString(hasher.Sum(nil)); md5sum != "" && downloadedMD5 != md5sum {
+		return fmt.Errorf("MD5 mismatch, expected %s but got %s", md5sum, downloadedMD5), 0
+	}
+
+	err = temporaryImageFile.Close()
+	if err != nil {
+		return err, 0
+	}
+
+	// rename temp image file to proper name
+	err = os.Rename(temporaryImageFile.Name(), imageDir+filename)
+	if err != nil {
+		log.Error("Failed to move image:", err.Error())
+		return err, 0
+	}
+
+	return nil, int(written)
+}
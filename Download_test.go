@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+var downloadTestBody = []byte("not really an image")
+
+func downloadTestMD5() string {
+	sum := md5.Sum(downloadTestBody)
+	return hex.EncodeToString(sum[:])
+}
+
+// newDownloadTestServer serves downloadTestBody, without Content-Length if chunked is set
+func newDownloadTestServer(chunked bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !chunked {
+			w.Header().Set("Content-Length", strconv.Itoa(len(downloadTestBody)))
+		}
+		_, _ = w.Write(downloadTestBody)
+		if chunked {
+			w.(http.Flusher).Flush()
+		}
+	}))
+}
+
+func assertNoTempFiles(t *testing.T, dir string) {
+	matches, _ := filepath.Glob(filepath.Join(dir, "temp-paktum-*"))
+	if len(matches) != 0 {
+		t.Errorf("temporary files were left behind: %v", matches)
+	}
+}
+
+func TestDownloadImageVerifiesMD5(t *testing.T) {
+	for _, chunked := range []bool{false, true} {
+		server := newDownloadTestServer(chunked)
+		dir := t.TempDir() + "/"
+
+		err, size := downloadImage(context.Background(), server.URL, dir, "image.png", downloadTestMD5(), 0)
+		if err != nil {
+			t.Fatalf("chunked=%v: %v", chunked, err)
+		}
+		if size != len(downloadTestBody) {
+			t.Errorf("chunked=%v: expected size %d, got %d", chunked, len(downloadTestBody), size)
+		}
+		if _, err := os.Stat(dir + "image.png"); err != nil {
+			t.Errorf("chunked=%v: image wasn't stored: %v", chunked, err)
+		}
+		assertNoTempFiles(t, dir)
+		server.Close()
+	}
+}
+
+func TestDownloadImageRejectsMismatchedMD5(t *testing.T) {
+	server := newDownloadTestServer(false)
+	defer server.Close()
+	dir := t.TempDir() + "/"
+
+	err, _ := downloadImage(context.Background(), server.URL, dir, "image.png", "00000000000000000000000000000000", 0)
+	if err == nil {
+		t.Fatal("expected an MD5 mismatch")
+	}
+	if _, err := os.Stat(dir + "image.png"); !os.IsNotExist(err) {
+		t.Error("mismatched image was stored")
+	}
+	assertNoTempFiles(t, dir)
+}
+
+func TestDownloadImageEnforcesMaxSize(t *testing.T) {
+	for _, chunked := range []bool{false, true} {
+		server := newDownloadTestServer(chunked)
+		dir := t.TempDir() + "/"
+
+		err, _ := downloadImage(context.Background(), server.URL, dir, "image.png", "", int64(len(downloadTestBody)-1))
+		if err == nil {
+			t.Errorf("chunked=%v: expected the size limit to be enforced", chunked)
+		}
+		assertNoTempFiles(t, dir)
+		server.Close()
+	}
+}
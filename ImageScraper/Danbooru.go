@@ -0,0 +1,184 @@
+package ImageScraper
+
+import (
+	"encoding/json"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DanbooruBaseURL = "https://danbooru.donmai.us"
+
+type DanbooruPost struct {
+	ID          int    `json:"id"`
+	CreatedAt   string `json:"created_at"`
+	Score       int    `json:"score"`
+	Source      string `json:"source"`
+	Md5         string `json:"md5"`
+	Rating      string `json:"rating"`
+	ImageWidth  int    `json:"image_width"`
+	ImageHeight int    `json:"image_height"`
+	TagString   string `json:"tag_string"`
+	FileExt     string `json:"file_ext"`
+	FileURL     string `json:"file_url"`
+	ParentID    int    `json:"parent_id"`
+	HasChildren bool   `json:"has_children"`
+}
+
+// DanbooruSource scrapes the Danbooru /posts.json API.
+// Login and APIKey are optional, but raise the tag limit and unlock restricted posts.
+type DanbooruSource struct {
+	BaseURL string
+	Login   string
+	APIKey  string
+}
+
+func init() {
+	RegisterSource(DanbooruSource{BaseURL: DanbooruBaseURL})
+}
+
+// SetDanbooruCredentials replaces the registered Danbooru source with one that authenticates using login and apiKey
+func SetDanbooruCredentials(login string, apiKey string) {
+	if login == "" || apiKey == "" {
+		return
+	}
+
+	RegisterSource(DanbooruSource{
+		BaseURL: DanbooruBaseURL,
+		Login:   login,
+		APIKey:  apiKey,
+	})
+}
+
+// danbooruRatings maps the single-letter Danbooru ratings onto the ones used by Paktum
+var danbooruRatings = map[string]string{
+	"g": "general",
+	"s": "safe",
+	"q": "questionable",
+	"e": "explicit",
+}
+
+func (DanbooruSource) Name() string {
+	return "danbooru"
+}
+
+func (d DanbooruSource) Search(tags []string, page uint) (error, []Image) {
+	err, images, _ := d.fetch(tags, page)
+	return err, images
+}
+
+// fetch requests a page of posts and returns its images along with the number of posts the API returned,
+// which includes the posts skipped for having no file
+func (d DanbooruSource) fetch(tags []string, page uint) (error, []Image, int) {
+	query := url.Values{}
+	query.Set("tags", strings.Join(tags, " "))
+	query.Set("page", strconv.Itoa(int(page)))
+	query.Set("limit", "100")
+	requestURL := strings.TrimSuffix(d.BaseURL, "/") + "/posts.json?" + query.Encode()
+	log.Trace("Requesting Danbooru page with URL: ", requestURL)
+
+	req, err := http.NewRequest(http.MethodGet, requestURL, nil)
+	if err != nil {
+		return err, nil, 0
+	}
+	req.Header.Set("User-Agent", "Paktum Scraper/Importer")
+	if d.Login != "" && d.APIKey != "" {
+		req.SetBasicAuth(d.Login, d.APIKey)
+	}
+
+	res, err := doRequest(req)
+	if err != nil {
+		return err, nil, 0
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return errors.New("Danbooru responded with status " + res.Status), nil, 0
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err, nil, 0
+	}
+
+	var posts []DanbooruPost
+	err = json.Unmarshal(body, &posts)
+	if err != nil {
+		return err, nil, 0
+	}
+
+	var images []Image
+	for _, post := range posts {
+		// restricted or deleted posts are returned without md5 and file URL
+		if post.Md5 == "" || post.FileURL == "" {
+			log.Debug("Skipping Danbooru post ", post.ID, " without file")
+			continue
+		}
+
+		images = append(images, post.toImage(d.BaseURL))
+	}
+
+	return nil, images, len(posts)
+}
+
+func (post DanbooruPost) toImage(baseURL string) Image {
+	parentID := ""
+	if post.ParentID != 0 {
+		parentID = strconv.Itoa(post.ParentID)
+	}
+
+	return Image{
+		ID:            strconv.Itoa(post.ID),
+		Filename:      post.Md5 + "." + post.FileExt,
+		FileURL:       post.FileURL,
+		Tags:          strings.Fields(post.TagString),
+		Rating:        danbooruRatings[post.Rating],
+		ParentID:      parentID,
+		HasChildren:   post.HasChildren,
+		Source:        "danbooru",
+		PageURL:       strings.TrimSuffix(baseURL, "/") + "/posts/" + strconv.Itoa(post.ID),
+		ArtworkSource: post.Source,
+		Score:         post.Score,
+		Uploaded:      parseUploadTime(time.RFC3339, post.CreatedAt),
+	}
+}
+
+func (d DanbooruSource) Paginate(query Query) (error, []Image, bool) {
+	tags := query.Tags
+	imageList := make([]Image, 0)
+	complete := false
+
+	// Danbooru pages are 1-indexed
+	for i := 1; query.PageAllowed(i - 1); i++ {
+		err, pageImages, posts := d.fetch(tags, uint(i))
+		if err != nil {
+			log.Error("Failed to scrape Danbooru: ", err)
+			return err, nil, false
+		}
+		images, reachedCheckpoint := query.FilterNew(pageImages)
+		log.Info("Got ", len(images), " images from Danbooru tags ", tags, ", page ", i)
+		imageList = append(imageList, images...)
+		if truncated, limitReached := query.Truncate(imageList); limitReached {
+			log.Info("Reached post limit of ", query.MaxPosts, " for Danbooru tag ", tags)
+			return nil, truncated, false
+		}
+		if reachedCheckpoint {
+			log.Info("Reached checkpoint ", query.SinceID, " of Danbooru tag ", tags)
+			complete = true
+			break
+		}
+		// a page of only restricted posts yields no images, but isn't the end of the results
+		if posts == 0 {
+			log.Info("Reached end of Danbooru tag ", tags, " at page ", i)
+			complete = true
+			break
+		}
+	}
+
+	return nil, imageList, complete
+}
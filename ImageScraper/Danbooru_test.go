@@ -0,0 +1,126 @@
+package ImageScraper
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func newDanbooruFixtureServer(t *testing.T) *httptest.Server {
+	fixture, err := os.ReadFile("testdata/danbooru_posts.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/posts.json" {
+			http.NotFound(w, r)
+			return
+		}
+		if login, apiKey, ok := r.BasicAuth(); ok && (login != "paktum" || apiKey != "secret") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Query().Get("tags") + "/" + r.URL.Query().Get("page") {
+		case "hug/1", "restricted/2":
+			_, _ = w.Write(fixture)
+		case "restricted/1":
+			// a page of only restricted posts, which come without md5 and file URL
+			_, _ = w.Write([]byte(`[{"id": 5823470, "rating": "e", "tag_string": "hug"}]`))
+		default:
+			_, _ = w.Write([]byte("[]"))
+		}
+	}))
+}
+
+func TestDanbooruSearch(t *testing.T) {
+	server := newDanbooruFixtureServer(t)
+	defer server.Close()
+
+	err, images := DanbooruSource{BaseURL: server.URL, Login: "paktum", APIKey: "secret"}.Search([]string{"hug"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the third fixture post has no md5 or file URL and must be skipped
+	if len(images) != 2 {
+		t.Fatalf("expected 2 images, got %d", len(images))
+	}
+
+	first := images[0]
+	if first.ID != "5823461" {
+		t.Errorf("unexpected ID %s", first.ID)
+	}
+	if first.Filename != "0b8c62a3d7e8d28d4e4c0a38ba61f5c1.jpg" {
+		t.Errorf("unexpected filename %s", first.Filename)
+	}
+	if first.FileURL != "https://cdn.donmai.us/original/0b/8c/0b8c62a3d7e8d28d4e4c0a38ba61f5c1.jpg" {
+		t.Errorf("unexpected file URL %s", first.FileURL)
+	}
+	if len(first.Tags) != 5 || first.Tags[3] != "long_hair" {
+		t.Errorf("unexpected tags %v", first.Tags)
+	}
+	if first.Rating != "general" {
+		t.Errorf("expected rating general, got %s", first.Rating)
+	}
+	if first.Source != "danbooru" || first.PageURL != server.URL+"/posts/5823461" {
+		t.Errorf("unexpected source %s and page URL %s", first.Source, first.PageURL)
+	}
+	if first.ArtworkSource != "https://twitter.com/example/status/1587853011842326528" || first.Score != 57 {
+		t.Errorf("unexpected artwork source %s and score %d", first.ArtworkSource, first.Score)
+	}
+	if first.Uploaded != 1667413267 {
+		t.Errorf("unexpected upload time %d", first.Uploaded)
+	}
+	if images[1].Rating != "questionable" {
+		t.Errorf("expected rating questionable, got %s", images[1].Rating)
+	}
+	if images[1].ParentID != "5823461" {
+		t.Errorf("expected parent 5823461, got %s", images[1].ParentID)
+	}
+}
+
+func TestDanbooruSearchUnauthorized(t *testing.T) {
+	server := newDanbooruFixtureServer(t)
+	defer server.Close()
+
+	err, _ := DanbooruSource{BaseURL: server.URL, Login: "paktum", APIKey: "wrong"}.Search([]string{"hug"}, 1)
+	if err == nil {
+		t.Fatal("expected error for rejected credentials")
+	}
+}
+
+func TestDanbooruPaginate(t *testing.T) {
+	server := newDanbooruFixtureServer(t)
+	defer server.Close()
+
+	err, images, complete := DanbooruSource{BaseURL: server.URL}.Paginate(Query{Tags: []string{"hug"}, MaxPages: DefaultMaxPages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 {
+		t.Fatalf("expected 2 images, got %d", len(images))
+	}
+	if !complete {
+		t.Error("expected the walk to reach the end of the results")
+	}
+}
+
+func TestDanbooruPaginateSkipsRestrictedPage(t *testing.T) {
+	server := newDanbooruFixtureServer(t)
+	defer server.Close()
+
+	err, images, complete := DanbooruSource{BaseURL: server.URL}.Paginate(Query{Tags: []string{"restricted"}, MaxPages: DefaultMaxPages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 {
+		t.Fatalf("expected the 2 images of the page after the restricted one, got %d", len(images))
+	}
+	if !complete {
+		t.Error("expected the walk to reach the end of the results")
+	}
+}
@@ -0,0 +1,205 @@
+package ImageScraper
+
+import (
+	"encoding/json"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// E621UserAgent identifies Paktum to e621, which rejects requests without a descriptive User-Agent
+const E621UserAgent = "Paktum Scraper/Importer (https://github.com/PrivateGER/Paktum)"
+
+type E621Page struct {
+	Posts []E621Post `json:"posts"`
+}
+
+type E621Post struct {
+	ID        int    `json:"id"`
+	CreatedAt string `json:"created_at"`
+	File      struct {
+		Width  int    `json:"width"`
+		Height int    `json:"height"`
+		Ext    string `json:"ext"`
+		Size   int    `json:"size"`
+		Md5    string `json:"md5"`
+		URL    string `json:"url"`
+	} `json:"file"`
+	Score struct {
+		Total int `json:"total"`
+	} `json:"score"`
+	Tags          map[string][]string `json:"tags"`
+	Rating        string              `json:"rating"`
+	Sources       []string            `json:"sources"`
+	Description   string              `json:"description"`
+	Relationships struct {
+		ParentID    int  `json:"parent_id"`
+		HasChildren bool `json:"has_children"`
+	} `json:"relationships"`
+}
+
+// e621TagCategories is the order in which the categorized tag object is flattened into Image.Tags.
+// The "invalid" category is left out on purpose.
+var e621TagCategories = []string{"artist", "copyright", "character", "species", "general", "lore", "meta"}
+
+var e621Ratings = map[string]string{
+	"s": "safe",
+	"q": "questionable",
+	"e": "explicit",
+}
+
+// E621Source scrapes e621-compatible /posts.json APIs, which includes its SFW mirror e926
+type E621Source struct {
+	SourceName string
+	BaseURL    string
+}
+
+func init() {
+	RegisterSource(E621Source{SourceName: "e621", BaseURL: "https://e621.net"})
+	RegisterSource(E621Source{SourceName: "e926", BaseURL: "https://e926.net"})
+
+	// e621 allows at most two requests per second
+	SetHostRateLimit("e621.net", time.Millisecond*500, 1)
+	SetHostRateLimit("e926.net", time.Millisecond*500, 1)
+}
+
+func (e E621Source) Name() string {
+	return e.SourceName
+}
+
+func (e E621Source) Search(tags []string, page uint) (error, []Image) {
+	err, images, _ := e.fetch(tags, strconv.Itoa(int(page)))
+	return err, images
+}
+
+// fetch requests a single page, page may either be a page number or a "b<id>" cursor.
+// Besides the images it returns the lowest post ID on the page, which is the cursor for the next page.
+func (e E621Source) fetch(tags []string, page string) (error, []Image, int) {
+	query := url.Values{}
+	query.Set("tags", strings.Join(tags, " "))
+	query.Set("limit", "320")
+	if page != "" {
+		query.Set("page", page)
+	}
+	requestURL := strings.TrimSuffix(e.BaseURL, "/") + "/posts.json?" + query.Encode()
+	log.Trace("Requesting ", e.SourceName, " page with URL: ", requestURL)
+
+	req, err := http.NewRequest(http.MethodGet, requestURL, nil)
+	if err != nil {
+		return err, nil, 0
+	}
+	req.Header.Set("User-Agent", E621UserAgent)
+
+	res, err := doRequest(req)
+	if err != nil {
+		return err, nil, 0
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return errors.New(e.SourceName + " responded with status " + res.Status), nil, 0
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err, nil, 0
+	}
+
+	var posts E621Page
+	err = json.Unmarshal(body, &posts)
+	if err != nil {
+		return err, nil, 0
+	}
+
+	lowestID := 0
+	images := make([]Image, 0, len(posts.Posts))
+	for _, post := range posts.Posts {
+		if lowestID == 0 || post.ID < lowestID {
+			lowestID = post.ID
+		}
+
+		// posts on the global blacklist are returned without a file URL to anonymous users
+		if post.File.Md5 == "" || post.File.URL == "" {
+			log.Debug("Skipping ", e.SourceName, " post ", post.ID, " without file")
+			continue
+		}
+
+		images = append(images, e.toImage(post))
+	}
+
+	return nil, images, lowestID
+}
+
+func (e E621Source) toImage(post E621Post) Image {
+	var tags []string
+	for _, category := range e621TagCategories {
+		tags = append(tags, post.Tags[category]...)
+	}
+
+	parentID := ""
+	if post.Relationships.ParentID != 0 {
+		parentID = strconv.Itoa(post.Relationships.ParentID)
+	}
+
+	artworkSource := ""
+	if len(post.Sources) > 0 {
+		artworkSource = post.Sources[0]
+	}
+
+	return Image{
+		ID:            strconv.Itoa(post.ID),
+		Filename:      post.File.Md5 + "." + post.File.Ext,
+		FileURL:       post.File.URL,
+		Tags:          tags,
+		Description:   post.Description,
+		Rating:        e621Ratings[post.Rating],
+		ParentID:      parentID,
+		HasChildren:   post.Relationships.HasChildren,
+		Source:        e.SourceName,
+		PageURL:       strings.TrimSuffix(e.BaseURL, "/") + "/posts/" + strconv.Itoa(post.ID),
+		ArtworkSource: artworkSource,
+		Score:         post.Score.Total,
+		Uploaded:      parseUploadTime(time.RFC3339, post.CreatedAt),
+	}
+}
+
+// Paginate walks the tag query using "b<id>" cursors, which unlike page numbers are not capped by e621
+func (e E621Source) Paginate(query Query) (error, []Image, bool) {
+	tags := query.Tags
+	imageList := make([]Image, 0)
+	complete := false
+
+	cursor := ""
+	for i := 0; query.PageAllowed(i); i++ {
+		err, pageImages, lowestID := e.fetch(tags, cursor)
+		if err != nil {
+			log.Error("Failed to scrape ", e.SourceName, ": ", err)
+			return err, nil, false
+		}
+		images, reachedCheckpoint := query.FilterNew(pageImages)
+		log.Info("Got ", len(images), " images from ", e.SourceName, " tags ", tags, ", page ", i)
+		imageList = append(imageList, images...)
+		if truncated, limitReached := query.Truncate(imageList); limitReached {
+			log.Info("Reached post limit of ", query.MaxPosts, " for ", e.SourceName, " tag ", tags)
+			return nil, truncated, false
+		}
+		if reachedCheckpoint {
+			log.Info("Reached checkpoint ", query.SinceID, " of ", e.SourceName, " tag ", tags)
+			complete = true
+			break
+		}
+		if lowestID == 0 {
+			log.Info("Reached end of ", e.SourceName, " tag ", tags, " at page ", i)
+			complete = true
+			break
+		}
+		cursor = "b" + strconv.Itoa(lowestID)
+	}
+
+	return nil, imageList, complete
+}
@@ -0,0 +1,152 @@
+package ImageScraper
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func newE621FixtureServer(t *testing.T) (*httptest.Server, *[]string) {
+	pages := make(map[string][]byte)
+	for cursor, file := range map[string]string{
+		"":         "testdata/e621_posts_page1.json",
+		"1":        "testdata/e621_posts_page1.json",
+		"b4102877": "testdata/e621_posts_page2.json",
+	} {
+		fixture, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages[cursor] = fixture
+	}
+
+	var requested []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/posts.json" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("User-Agent") != E621UserAgent {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		page := r.URL.Query().Get("page")
+		requested = append(requested, page)
+
+		w.Header().Set("Content-Type", "application/json")
+		fixture, ok := pages[page]
+		if r.URL.Query().Get("tags") != "hug" || !ok {
+			_, _ = w.Write([]byte(`{"posts":[]}`))
+			return
+		}
+		_, _ = w.Write(fixture)
+	}))
+	return server, &requested
+}
+
+func TestE621Search(t *testing.T) {
+	server, _ := newE621FixtureServer(t)
+	defer server.Close()
+
+	err, images := E621Source{SourceName: "e621", BaseURL: server.URL}.Search([]string{"hug"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 {
+		t.Fatalf("expected 2 images, got %d", len(images))
+	}
+
+	first := images[0]
+	expectedTags := []string{"example_artist", "example_series", "example_character", "canine", "mammal", "hug", "smile", "hi_res"}
+	if !reflect.DeepEqual(first.Tags, expectedTags) {
+		t.Errorf("expected tags in category order without invalid ones, got %v", first.Tags)
+	}
+	if first.ID != "4102931" || first.Filename != "a3f1c07d2be94e8c5f1d6a0e9b7c4d21.png" {
+		t.Errorf("unexpected ID %s and filename %s", first.ID, first.Filename)
+	}
+	if first.Rating != "safe" || first.Score != 212 {
+		t.Errorf("unexpected rating %s and score %d", first.Rating, first.Score)
+	}
+	if first.ParentID != "" || !first.HasChildren {
+		t.Errorf("expected a parent without a parent of its own, got parent %q and children %v", first.ParentID, first.HasChildren)
+	}
+	if first.Source != "e621" || first.PageURL != server.URL+"/posts/4102931" {
+		t.Errorf("unexpected source %s and page URL %s", first.Source, first.PageURL)
+	}
+	if first.ArtworkSource != "https://www.furaffinity.net/view/52512345/" {
+		t.Errorf("unexpected artwork source %s", first.ArtworkSource)
+	}
+	if first.Uploaded != 1686607491 {
+		t.Errorf("unexpected upload time %d", first.Uploaded)
+	}
+
+	if images[1].ParentID != "4102931" || images[1].Rating != "questionable" || images[1].ArtworkSource != "" {
+		t.Errorf("unexpected second image %+v", images[1])
+	}
+}
+
+func TestE621PaginateFollowsCursor(t *testing.T) {
+	server, requested := newE621FixtureServer(t)
+	defer server.Close()
+
+	err, images, complete := E621Source{SourceName: "e621", BaseURL: server.URL}.Paginate(Query{Tags: []string{"hug"}, MaxPages: DefaultMaxPages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !complete {
+		t.Error("expected the walk to reach the end of the results")
+	}
+
+	// every page after the first continues below the lowest ID of the previous one, including posts that were skipped
+	if expected := []string{"", "b4102877", "b4101002"}; !reflect.DeepEqual(*requested, expected) {
+		t.Errorf("expected pages %v, got %v", expected, *requested)
+	}
+
+	// the last post of the second page has no file and must be skipped
+	var ids []string
+	for _, image := range images {
+		ids = append(ids, image.ID)
+	}
+	if expected := []string{"4102931", "4102877", "4101550"}; !reflect.DeepEqual(ids, expected) {
+		t.Errorf("expected images %v, got %v", expected, ids)
+	}
+}
+
+func TestE621PaginateStopsAtCheckpoint(t *testing.T) {
+	server, requested := newE621FixtureServer(t)
+	defer server.Close()
+
+	query := Query{Tags: []string{"hug"}, MaxPages: DefaultMaxPages, SinceID: 4102877}
+	err, images, complete := E621Source{SourceName: "e621", BaseURL: server.URL}.Paginate(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !complete {
+		t.Error("expected the walk to count as complete once it reached the checkpoint")
+	}
+
+	if len(*requested) != 1 {
+		t.Errorf("expected a single request, got pages %v", *requested)
+	}
+	if len(images) != 1 || images[0].ID != "4102931" {
+		t.Errorf("expected only the image newer than the checkpoint, got %+v", images)
+	}
+}
+
+func TestE621PaginateCutShortIsIncomplete(t *testing.T) {
+	server, _ := newE621FixtureServer(t)
+	defer server.Close()
+
+	// the checkpoint is on the second page, which the page limit doesn't allow
+	query := Query{Tags: []string{"hug"}, MaxPages: 1, SinceID: 4101002}
+	err, images, complete := E621Source{SourceName: "e621", BaseURL: server.URL}.Paginate(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 || complete {
+		t.Errorf("expected 2 images from an incomplete walk, got %d images and complete %v", len(images), complete)
+	}
+}
@@ -2,14 +2,18 @@ package ImageScraper
 
 import (
 	"encoding/json"
+	"errors"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
 )
 
+const GelbooruBaseURL = "https://gelbooru.com"
+
 type GelbooruPage struct {
 	Attributes struct {
 		Limit  int `json:"limit"`
@@ -49,75 +53,163 @@ type GelbooruPage struct {
 	} `json:"post"`
 }
 
-func scrape(tags []string, page uint) (error, []Image) {
-	url := "https://gelbooru.com/index.php?page=dapi&s=post&q=index&pid=" + strconv.Itoa(int(page)) + "&json=1&tags=" + strings.Join(tags, "+")
-	log.Trace("Requesting Gelbooru page with URL: ", url)
+// GelbooruSource scrapes the Gelbooru dapi JSON API
+type GelbooruSource struct {
+	BaseURL string
+}
 
-	httpClient := http.Client{
-		Timeout: time.Second * 5,
-	}
+func init() {
+	RegisterSource(GelbooruSource{BaseURL: GelbooruBaseURL})
+}
+
+func (GelbooruSource) Name() string {
+	return "gelbooru"
+}
+
+// gelbooruPageSize is the number of posts requested per page, which is also the maximum Gelbooru allows
+const gelbooruPageSize = 100
+
+// gelbooruMaxOffset is the highest post offset (pid * limit) Gelbooru serves, deeper pages need "id:<N" cursoring
+const gelbooruMaxOffset = 20000
 
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+func (g GelbooruSource) Search(tags []string, page uint) (error, []Image) {
+	err, posts := g.fetch(tags, page)
 	if err != nil {
 		return err, nil
 	}
-	req.Header.Set("User-Agent", "Paktum Scraper/Importer")
 
-	res, err := httpClient.Do(req)
+	return nil, posts.toImages(g.BaseURL)
+}
+
+func (g GelbooruSource) fetch(tags []string, page uint) (error, GelbooruPage) {
+	query := url.Values{}
+	query.Set("page", "dapi")
+	query.Set("s", "post")
+	query.Set("q", "index")
+	query.Set("json", "1")
+	query.Set("limit", strconv.Itoa(gelbooruPageSize))
+	query.Set("pid", strconv.Itoa(int(page)))
+	query.Set("tags", strings.Join(tags, " "))
+	requestURL := strings.TrimSuffix(g.BaseURL, "/") + "/index.php?" + query.Encode()
+	log.Trace("Requesting Gelbooru page with URL: ", requestURL)
 
+	req, err := http.NewRequest(http.MethodGet, requestURL, nil)
 	if err != nil {
-		return err, nil
+		return err, GelbooruPage{}
 	}
-	if res.Body == nil && res.StatusCode != http.StatusOK {
-		return nil, nil
+	req.Header.Set("User-Agent", "Paktum Scraper/Importer")
+
+	res, err := doRequest(req)
+	if err != nil {
+		return err, GelbooruPage{}
 	}
+	defer res.Body.Close()
 
-	if res.Body != nil {
-		defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errors.New("Gelbooru responded with status " + res.Status), GelbooruPage{}
 	}
 
 	body, readErr := io.ReadAll(res.Body)
 	if readErr != nil {
-		log.Fatal(readErr)
+		return readErr, GelbooruPage{}
 	}
 
 	var posts GelbooruPage
 	jsonErr := json.Unmarshal(body, &posts)
 	if jsonErr != nil {
-		return jsonErr, nil
+		return jsonErr, GelbooruPage{}
 	}
 
+	return nil, posts
+}
+
+func (posts GelbooruPage) toImages(baseURL string) []Image {
 	var images []Image
 	for _, post := range posts.GelbooruImage {
+		parentID := ""
+		if post.ParentID != 0 {
+			parentID = strconv.Itoa(post.ParentID)
+		}
+
 		images = append(images, Image{
-			ID:          string(strconv.Itoa(post.ID)),
-			Filename:    post.Image,
-			FileURL:     post.FileURL,
-			Tags:        strings.Split(post.Tags, " "),
-			Description: post.Title,
-			Rating:      post.Rating,
+			ID:            string(strconv.Itoa(post.ID)),
+			Filename:      post.Image,
+			FileURL:       post.FileURL,
+			Tags:          strings.Split(post.Tags, " "),
+			Description:   post.Title,
+			Rating:        post.Rating,
+			ParentID:      parentID,
+			HasChildren:   post.HasChildren == "true",
+			Source:        "gelbooru",
+			PageURL:       strings.TrimSuffix(baseURL, "/") + "/index.php?page=post&s=view&id=" + strconv.Itoa(post.ID),
+			ArtworkSource: post.Source,
+			Score:         post.Score,
+			Uploaded:      parseUploadTime(time.RubyDate, post.CreatedAt),
 		})
 	}
 
-	return nil, images
+	return images
 }
 
-func Gelbooru(tags []string) (error, []Image) {
+// Paginate walks the query page by page until the total post count from @attributes is reached.
+// Once the next page would exceed gelbooruMaxOffset, it continues with an "id:<N" cursor below the lowest ID seen so far.
+func (g GelbooruSource) Paginate(query Query) (error, []Image, bool) {
+	tags := query.Tags
 	imageList := make([]Image, 0)
+	complete := false
 
-	for i := 0; i < 5; i++ {
-		err, images := scrape(tags, uint(i))
+	total := -1
+	seen := 0
+	pid := 0
+	cursor := 0
+	for i := 0; query.PageAllowed(i); i++ {
+		pageTags := tags
+		if cursor != 0 {
+			pageTags = append(append([]string{}, tags...), "id:<"+strconv.Itoa(cursor))
+		}
+
+		err, posts := g.fetch(pageTags, uint(pid))
 		if err != nil {
 			log.Error("Failed to scrape Gelbooru: ", err)
-			return err, nil
+			return err, nil, false
 		}
+		if total == -1 {
+			total = posts.Attributes.Count
+			log.Info("Gelbooru tags ", tags, " have ", total, " posts")
+		}
+
+		images, reachedCheckpoint := query.FilterNew(posts.toImages(g.BaseURL))
 		log.Info("Got ", len(images), " images from Gelbooru tags ", tags, ", page ", i)
 		imageList = append(imageList, images...)
-		if len(images) == 0 {
+		if truncated, limitReached := query.Truncate(imageList); limitReached {
+			log.Info("Reached post limit of ", query.MaxPosts, " for Gelbooru tag ", tags)
+			return nil, truncated, false
+		}
+
+		if reachedCheckpoint {
+			log.Info("Reached checkpoint ", query.SinceID, " of Gelbooru tag ", tags, " at page ", i)
+			complete = true
+			break
+		}
+
+		seen += len(posts.GelbooruImage)
+		if len(posts.GelbooruImage) == 0 || seen >= total {
 			log.Info("Reached end of Gelbooru tag ", tags, " at page ", i)
+			complete = true
 			break
 		}
+
+		pid++
+		if (pid+1)*gelbooruPageSize > gelbooruMaxOffset {
+			for _, post := range posts.GelbooruImage {
+				if cursor == 0 || post.ID < cursor {
+					cursor = post.ID
+				}
+			}
+			pid = 0
+			log.Info("Reached Gelbooru page limit for tag ", tags, ", continuing below post ", cursor)
+		}
 	}
 
-	return nil, imageList
+	return nil, imageList, complete
 }
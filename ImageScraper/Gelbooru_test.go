@@ -0,0 +1,129 @@
+package ImageScraper
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newGelbooruFixtureServer(t *testing.T) (*httptest.Server, *[]string) {
+	pages := make(map[string][]byte)
+	for pid, file := range map[string]string{
+		"0": "testdata/gelbooru_posts_page1.json",
+		"1": "testdata/gelbooru_posts_page2.json",
+	} {
+		fixture, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages[pid] = fixture
+	}
+
+	var requested []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.URL.Path != "/index.php" || query.Get("page") != "dapi" || query.Get("json") != "1" {
+			http.NotFound(w, r)
+			return
+		}
+
+		tags, pid := query.Get("tags"), query.Get("pid")
+		requested = append(requested, pid+" "+tags)
+
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case tags == "hug" && pages[pid] != nil:
+			_, _ = w.Write(pages[pid])
+		case tags == "deep":
+			// a query with more posts than the offset limit allows, every page ends at the same lowest ID
+			_, _ = w.Write([]byte(`{"@attributes": {"limit": 100, "offset": 0, "count": 50000}, "post": [
+				{"id": 9000100, "md5": "a87ff679a2f3e71d9181a67b7542122c", "image": "a87ff679a2f3e71d9181a67b7542122c.jpg", "tags": "deep", "file_url": "https://img3.gelbooru.com/images/a8/7f/a87ff679a2f3e71d9181a67b7542122c.jpg"},
+				{"id": 9000050, "md5": "e4da3b7fbbce2345d7772b0674a318d5", "image": "e4da3b7fbbce2345d7772b0674a318d5.jpg", "tags": "deep", "file_url": "https://img3.gelbooru.com/images/e4/da/e4da3b7fbbce2345d7772b0674a318d5.jpg"}
+			]}`))
+		default:
+			// Gelbooru leaves out the post array once there are no more posts
+			_, _ = w.Write([]byte(`{"@attributes": {"limit": 100, "offset": 0, "count": 0}}`))
+		}
+	}))
+	return server, &requested
+}
+
+func TestGelbooruSearch(t *testing.T) {
+	server, _ := newGelbooruFixtureServer(t)
+	defer server.Close()
+
+	err, images := GelbooruSource{BaseURL: server.URL}.Search([]string{"hug"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 {
+		t.Fatalf("expected 2 images, got %d", len(images))
+	}
+
+	first := images[0]
+	if first.ID != "8123457" || first.Filename != "3c59dc048e8850243be8079a5c74d079.jpg" {
+		t.Errorf("unexpected ID %s and filename %s", first.ID, first.Filename)
+	}
+	if !reflect.DeepEqual(first.Tags, []string{"1girl", "hug", "smile"}) {
+		t.Errorf("unexpected tags %v", first.Tags)
+	}
+	if first.Source != "gelbooru" || first.PageURL != server.URL+"/index.php?page=post&s=view&id=8123457" {
+		t.Errorf("unexpected source %s and page URL %s", first.Source, first.PageURL)
+	}
+	if !first.HasChildren || first.Uploaded != 1667673731 {
+		t.Errorf("unexpected children %v and upload time %d", first.HasChildren, first.Uploaded)
+	}
+	if images[1].ParentID != "8123457" {
+		t.Errorf("expected parent 8123457, got %s", images[1].ParentID)
+	}
+}
+
+func TestGelbooruPaginateStopsAtCount(t *testing.T) {
+	server, requested := newGelbooruFixtureServer(t)
+	defer server.Close()
+
+	err, images, complete := GelbooruSource{BaseURL: server.URL}.Paginate(Query{Tags: []string{"hug"}, MaxPages: DefaultMaxPages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !complete {
+		t.Error("expected the walk to reach the end of the results")
+	}
+
+	// the second page brings the posts up to the count of @attributes, so no third page is requested
+	if expected := []string{"0 hug", "1 hug"}; !reflect.DeepEqual(*requested, expected) {
+		t.Errorf("expected requests %v, got %v", expected, *requested)
+	}
+	if len(images) != 3 || images[2].ID != "8123350" {
+		t.Errorf("expected the 3 images of both pages, got %+v", images)
+	}
+}
+
+func TestGelbooruPaginateSwitchesToCursorAtOffsetLimit(t *testing.T) {
+	server, requested := newGelbooruFixtureServer(t)
+	defer server.Close()
+	SetHostRateLimit(server.Listener.Addr().String(), time.Microsecond, 1000)
+
+	err, _, complete := GelbooruSource{BaseURL: server.URL}.Paginate(Query{Tags: []string{"deep"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !complete {
+		t.Error("expected the walk to reach the end of the results")
+	}
+
+	// pages 0 to 199 stay within the offset limit, the walk then continues below the lowest ID seen from page 0 again
+	lastPage := gelbooruMaxOffset / gelbooruPageSize
+	if len(*requested) != lastPage+1 {
+		t.Fatalf("expected %d requests, got %d", lastPage+1, len(*requested))
+	}
+	if (*requested)[lastPage-1] != "199 deep" {
+		t.Errorf("expected the last paged request to be pid 199, got %q", (*requested)[lastPage-1])
+	}
+	if (*requested)[lastPage] != "0 deep id:<9000050" {
+		t.Errorf("expected the cursor request to restart at pid 0 below 9000050, got %q", (*requested)[lastPage])
+	}
+}
@@ -1,23 +1,255 @@
 package ImageScraper
 
-import log "github.com/sirupsen/logrus"
+import (
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
 
+// Image is a scraped post. The JSON field names are part of the queue payload schema, see Database.PayloadVersion.
 type Image struct {
-	ID          string
-	Filename    string
-	FileURL     string
-	Tags        []string
-	Description string
-	Rating      string
+	// ID is the post ID on the source
+	ID          string   `json:"id"`
+	Filename    string   `json:"filename"`
+	FileURL     string   `json:"file_url"`
+	Tags        []string `json:"tags"`
+	Description string   `json:"description"`
+	Rating      string   `json:"rating"`
+	// ParentID is the source post ID of the parent post, if the source tracks post relationships
+	ParentID    string `json:"parent_id"`
+	HasChildren bool   `json:"has_children"`
+	// Source is the name of the source the image was scraped from
+	Source string `json:"source"`
+	// PageURL links to the post on the source
+	PageURL string `json:"page_url"`
+	// ArtworkSource is where the uploader got the image from, usually the artist's page
+	ArtworkSource string `json:"artwork_source"`
+	Score         int    `json:"score"`
+	// Uploaded is the UNIX timestamp of when the post was created on the source, 0 if unknown
+	Uploaded int64 `json:"uploaded"`
 }
 
-func Scrape(tags []string) (error, [][]Image) {
-	err, images := Gelbooru(tags)
+// parseUploadTime converts a source timestamp into a UNIX timestamp, returning 0 if it can't be parsed
+func parseUploadTime(layout string, value string) int64 {
+	uploaded, err := time.Parse(layout, value)
+	if err != nil {
+		return 0
+	}
+	return uploaded.Unix()
+}
+
+// Source is a site that images can be scraped from.
+// Implementations register themselves with RegisterSource in their init function.
+type Source interface {
+	// Name returns the identifier used to select this source in scrape queries, e.g. "gelbooru"
+	Name() string
+	// Search fetches a single page of posts matching the tags and maps them into Images
+	Search(tags []string, page uint) (error, []Image)
+	// Paginate walks over the pages of a query, honoring its MaxPages and MaxPosts, and returns the collected Images.
+	// The last return value is true if the walk reached the checkpoint or the end of the results, and false if a limit cut it short
+	Paginate(query Query) (error, []Image, bool)
+}
+
+// DefaultSource is used for scrape queries that don't name a source
+const DefaultSource = "gelbooru"
+
+var sources = make(map[string]Source)
+
+func RegisterSource(source Source) {
+	sources[source.Name()] = source
+	log.Debug("Registered scraper source ", source.Name())
+}
+
+func GetSource(name string) (Source, bool) {
+	source, ok := sources[strings.ToLower(name)]
+	return source, ok
+}
+
+// SourceNames returns the names of all registered sources in alphabetical order
+func SourceNames() []string {
+	var names []string
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DefaultMaxPages is the number of pages fetched for queries that don't set max_pages
+const DefaultMaxPages = 5
+
+// Query is a single tag query against one source
+type Query struct {
+	Source Source
+	Tags   []string
+	// MaxPages is the maximum number of pages to fetch, 0 fetches all pages
+	MaxPages int
+	// MaxPosts is the maximum number of posts to collect, 0 collects all posts
+	MaxPosts int
+	// SinceID is the checkpoint of the query, only posts with a higher ID are collected. 0 collects all posts
+	SinceID int
+	// IgnoreCheckpoint makes scrape mode fetch the query without applying its stored checkpoint
+	IgnoreCheckpoint bool
+	// Lane is the priority lane the scraped batches are queued in, empty uses the default lane of the scraping mode
+	Lane string
+}
+
+// Key identifies the query for checkpointing, it consists of the source name and the sorted tags
+func (q Query) Key() string {
+	tags := append([]string{}, q.Tags...)
+	sort.Strings(tags)
+	return q.Source.Name() + ":" + strings.Join(tags, " ")
+}
+
+// NewestFirst reports whether the source returns the posts of the query newest first, which checkpoints rely on.
+// Tags like "order:score" or "sort:score" change the order, so such queries are scraped without checkpoints.
+func (q Query) NewestFirst() bool {
+	for _, tag := range q.Tags {
+		tag = strings.ToLower(tag)
+		if strings.HasPrefix(tag, "order:") || strings.HasPrefix(tag, "sort:") {
+			return false
+		}
+	}
+	return true
+}
+
+// FilterNew drops all images that aren't newer than SinceID.
+// Sources return posts newest first, so the second return value being true means the rest of the query is already known.
+func (q Query) FilterNew(images []Image) ([]Image, bool) {
+	if q.SinceID == 0 {
+		return images, false
+	}
+
+	newImages := make([]Image, 0, len(images))
+	reachedCheckpoint := false
+	for _, image := range images {
+		id, err := strconv.Atoi(image.ID)
+		if err == nil && id <= q.SinceID {
+			reachedCheckpoint = true
+			continue
+		}
+		newImages = append(newImages, image)
+	}
+
+	return newImages, reachedCheckpoint
+}
+
+// HighestID returns the highest numeric post ID in batches, or 0 if there is none
+func HighestID(batches [][]Image) int {
+	highest := 0
+	for _, batch := range batches {
+		for _, image := range batch {
+			id, err := strconv.Atoi(image.ID)
+			if err == nil && id > highest {
+				highest = id
+			}
+		}
+	}
+	return highest
+}
+
+// PageAllowed reports whether another page may be fetched after fetched pages
+func (q Query) PageAllowed(fetched int) bool {
+	return q.MaxPages == 0 || fetched < q.MaxPages
+}
+
+// Truncate cuts images down to MaxPosts, the second return value is true once the limit is reached
+func (q Query) Truncate(images []Image) ([]Image, bool) {
+	if q.MaxPosts != 0 && len(images) >= q.MaxPosts {
+		return images[:q.MaxPosts], true
+	}
+	return images, false
+}
+
+// ParseQuery parses a line of the form "[source:]tag1 tag2 ... [max_pages=N|all] [max_posts=N|all] [since=all] [lane=NAME]" into a Query.
+// The source prefix is only split off when it names a registered source, so tags like "rating:safe" still work.
+// Lines without a source prefix use DefaultSource.
+func ParseQuery(line string) (error, Query) {
+	query := Query{MaxPages: DefaultMaxPages}
+
+	var tags []string
+	for _, field := range strings.Fields(line) {
+		option, value, _ := strings.Cut(field, "=")
+		switch option {
+		case "max_pages":
+			err, limit := parseLimit(value)
+			if err != nil {
+				return errors.New("invalid max_pages: " + err.Error()), Query{}
+			}
+			query.MaxPages = limit
+		case "max_posts":
+			err, limit := parseLimit(value)
+			if err != nil {
+				return errors.New("invalid max_posts: " + err.Error()), Query{}
+			}
+			query.MaxPosts = limit
+		case "since":
+			if value != "all" {
+				return errors.New("invalid since: only \"all\" is supported"), Query{}
+			}
+			query.IgnoreCheckpoint = true
+		case "lane":
+			if value == "" {
+				return errors.New("invalid lane: empty lane name"), Query{}
+			}
+			query.Lane = value
+		default:
+			tags = append(tags, field)
+		}
+	}
+	if len(tags) == 0 {
+		return errors.New("empty query"), Query{}
+	}
+
+	if prefix, tag, found := strings.Cut(tags[0], ":"); found {
+		if source, ok := GetSource(prefix); ok {
+			tags[0] = tag
+			if tag == "" {
+				tags = tags[1:]
+			}
+			query.Source = source
+			query.Tags = tags
+			return nil, query
+		}
+	}
+
+	source, ok := GetSource(DefaultSource)
+	if !ok {
+		return errors.New("default source " + DefaultSource + " is not registered"), Query{}
+	}
+
+	query.Source = source
+	query.Tags = tags
+	return nil, query
+}
+
+// parseLimit parses a max_pages/max_posts value, "all" is returned as 0
+func parseLimit(value string) (error, int) {
+	if value == "all" {
+		return nil, 0
+	}
+
+	limit, err := strconv.Atoi(value)
+	if err != nil {
+		return err, 0
+	}
+	if limit < 1 {
+		return errors.New("must be at least 1 or \"all\""), 0
+	}
+	return nil, limit
+}
+
+// Scrape paginates the query and splits the images into batches, the last return value is the one of Source.Paginate
+func Scrape(query Query) (error, [][]Image, bool) {
+	err, images, complete := query.Source.Paginate(query)
 	batchSize := 100
 	var batches [][]Image
 	if err != nil {
-		log.Error("Failed to scrape Gelbooru: ", err)
-		return err, nil
+		log.Error("Failed to scrape ", query.Source.Name(), ": ", err)
+		return err, nil, false
 	}
 
 	// go over images and split into batches of 50
@@ -29,5 +261,5 @@ func Scrape(tags []string) (error, [][]Image) {
 		batches = append(batches, images[i:end])
 	}
 
-	return err, batches
+	return err, batches, complete
 }
@@ -0,0 +1,22 @@
+package ImageScraper
+
+import "testing"
+
+func TestParseQueryOrderDisablesCheckpoint(t *testing.T) {
+	for line, newestFirst := range map[string]bool{
+		"hug":                          true,
+		"danbooru:hug order:score":     false,
+		"gelbooru:hug sort:score:desc": false,
+		"e621:hug Order:Favcount":      false,
+		"yandere:hug rating:safe":      true,
+		"hug max_pages=all since=all":  true,
+	} {
+		err, query := ParseQuery(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if query.NewestFirst() != newestFirst {
+			t.Errorf("expected NewestFirst of %q to be %v", line, newestFirst)
+		}
+	}
+}
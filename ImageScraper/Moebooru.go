@@ -0,0 +1,172 @@
+package ImageScraper
+
+import (
+	"encoding/json"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// MoebooruPost is a single entry of the Moebooru post.json API.
+// Unlike Gelbooru, the response is a plain array of posts without an envelope.
+type MoebooruPost struct {
+	ID          int    `json:"id"`
+	Tags        string `json:"tags"`
+	CreatedAt   int64  `json:"created_at"`
+	Author      string `json:"author"`
+	Source      string `json:"source"`
+	Score       int    `json:"score"`
+	Md5         string `json:"md5"`
+	FileSize    int    `json:"file_size"`
+	FileExt     string `json:"file_ext"`
+	FileURL     string `json:"file_url"`
+	Rating      string `json:"rating"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	ParentID    int    `json:"parent_id"`
+	HasChildren bool   `json:"has_children"`
+}
+
+var moebooruRatings = map[string]string{
+	"s": "safe",
+	"q": "questionable",
+	"e": "explicit",
+}
+
+// MoebooruSource scrapes Moebooru sites like Yande.re and Konachan
+type MoebooruSource struct {
+	SourceName string
+	BaseURL    string
+}
+
+func init() {
+	RegisterSource(MoebooruSource{SourceName: "yandere", BaseURL: "https://yande.re"})
+	RegisterSource(MoebooruSource{SourceName: "konachan", BaseURL: "https://konachan.com"})
+}
+
+func (m MoebooruSource) Name() string {
+	return m.SourceName
+}
+
+func (m MoebooruSource) Search(tags []string, page uint) (error, []Image) {
+	err, images, _ := m.fetch(tags, page)
+	return err, images
+}
+
+// fetch requests a page of posts and returns its images along with the number of posts the API returned,
+// which includes the posts skipped for having no file
+func (m MoebooruSource) fetch(tags []string, page uint) (error, []Image, int) {
+	query := url.Values{}
+	query.Set("tags", strings.Join(tags, " "))
+	query.Set("page", strconv.Itoa(int(page)))
+	query.Set("limit", "100")
+	requestURL := strings.TrimSuffix(m.BaseURL, "/") + "/post.json?" + query.Encode()
+	log.Trace("Requesting ", m.SourceName, " page with URL: ", requestURL)
+
+	req, err := http.NewRequest(http.MethodGet, requestURL, nil)
+	if err != nil {
+		return err, nil, 0
+	}
+	req.Header.Set("User-Agent", "Paktum Scraper/Importer")
+
+	res, err := doRequest(req)
+	if err != nil {
+		return err, nil, 0
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return errors.New(m.SourceName + " responded with status " + res.Status), nil, 0
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err, nil, 0
+	}
+
+	var posts []MoebooruPost
+	err = json.Unmarshal(body, &posts)
+	if err != nil {
+		return err, nil, 0
+	}
+
+	var images []Image
+	for _, post := range posts {
+		if post.Md5 == "" || post.FileURL == "" {
+			log.Debug("Skipping ", m.SourceName, " post ", post.ID, " without file")
+			continue
+		}
+
+		images = append(images, m.toImage(post))
+	}
+
+	return nil, images, len(posts)
+}
+
+func (m MoebooruSource) toImage(post MoebooruPost) Image {
+	// older Konachan posts don't carry file_ext, so fall back to the extension of the file URL
+	ext := post.FileExt
+	if ext == "" {
+		ext = strings.TrimPrefix(path.Ext(post.FileURL), ".")
+	}
+
+	parentID := ""
+	if post.ParentID != 0 {
+		parentID = strconv.Itoa(post.ParentID)
+	}
+
+	return Image{
+		ID:            strconv.Itoa(post.ID),
+		Filename:      post.Md5 + "." + ext,
+		FileURL:       post.FileURL,
+		Tags:          strings.Fields(post.Tags),
+		Rating:        moebooruRatings[post.Rating],
+		ParentID:      parentID,
+		HasChildren:   post.HasChildren,
+		Source:        m.SourceName,
+		PageURL:       strings.TrimSuffix(m.BaseURL, "/") + "/post/show/" + strconv.Itoa(post.ID),
+		ArtworkSource: post.Source,
+		Score:         post.Score,
+		Uploaded:      post.CreatedAt,
+	}
+}
+
+func (m MoebooruSource) Paginate(query Query) (error, []Image, bool) {
+	tags := query.Tags
+	imageList := make([]Image, 0)
+	complete := false
+
+	// Moebooru pages are 1-indexed
+	for i := 1; query.PageAllowed(i - 1); i++ {
+		err, pageImages, posts := m.fetch(tags, uint(i))
+		if err != nil {
+			log.Error("Failed to scrape ", m.SourceName, ": ", err)
+			return err, nil, false
+		}
+		images, reachedCheckpoint := query.FilterNew(pageImages)
+		log.Info("Got ", len(images), " images from ", m.SourceName, " tags ", tags, ", page ", i)
+		imageList = append(imageList, images...)
+		if truncated, limitReached := query.Truncate(imageList); limitReached {
+			log.Info("Reached post limit of ", query.MaxPosts, " for ", m.SourceName, " tag ", tags)
+			return nil, truncated, false
+		}
+		if reachedCheckpoint {
+			log.Info("Reached checkpoint ", query.SinceID, " of ", m.SourceName, " tag ", tags)
+			complete = true
+			break
+		}
+		// a page of only deleted posts yields no images, but isn't the end of the results
+		if posts == 0 {
+			log.Info("Reached end of ", m.SourceName, " tag ", tags, " at page ", i)
+			complete = true
+			break
+		}
+	}
+
+	return nil, imageList, complete
+}
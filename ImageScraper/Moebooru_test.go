@@ -0,0 +1,103 @@
+package ImageScraper
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func newMoebooruFixtureServer(t *testing.T) *httptest.Server {
+	fixture, err := os.ReadFile("testdata/moebooru_posts.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/post.json" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Query().Get("tags") + "/" + r.URL.Query().Get("page") {
+		case "hatsune_miku/1", "deleted/2":
+			_, _ = w.Write(fixture)
+		case "deleted/1":
+			// a page of only deleted posts, which come without md5 and file URL
+			_, _ = w.Write([]byte(`[{"id": 1093350, "rating": "s", "tags": "hatsune_miku"}]`))
+		default:
+			_, _ = w.Write([]byte("[]"))
+		}
+	}))
+}
+
+func TestMoebooruSearch(t *testing.T) {
+	server := newMoebooruFixtureServer(t)
+	defer server.Close()
+
+	err, images := MoebooruSource{SourceName: "yandere", BaseURL: server.URL}.Search([]string{"hatsune_miku"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the third fixture post has no md5 or file URL and must be skipped
+	if len(images) != 2 {
+		t.Fatalf("expected 2 images, got %d", len(images))
+	}
+
+	parent := images[0]
+	if parent.ID != "1093344" || parent.Filename != "e4d909c290d0fb1ca068ffaddf22cbd0.png" {
+		t.Errorf("unexpected ID %s and filename %s", parent.ID, parent.Filename)
+	}
+	if parent.ParentID != "" || !parent.HasChildren {
+		t.Errorf("expected a parent without a parent of its own, got parent %q and children %v", parent.ParentID, parent.HasChildren)
+	}
+	if len(parent.Tags) != 4 || parent.Tags[2] != "dress" {
+		t.Errorf("unexpected tags %v", parent.Tags)
+	}
+	if parent.Rating != "safe" || parent.Score != 31 || parent.Uploaded != 1689012345 {
+		t.Errorf("unexpected rating %s, score %d and upload time %d", parent.Rating, parent.Score, parent.Uploaded)
+	}
+	if parent.Source != "yandere" || parent.PageURL != server.URL+"/post/show/1093344" {
+		t.Errorf("unexpected source %s and page URL %s", parent.Source, parent.PageURL)
+	}
+
+	child := images[1]
+	if child.ParentID != "1093344" || child.HasChildren {
+		t.Errorf("expected a child of 1093344 without children, got parent %q and children %v", child.ParentID, child.HasChildren)
+	}
+	// the child has no file_ext, so the extension comes from its file URL
+	if child.Filename != "9e107d9d372bb6826bd81d3542a419d6.jpg" {
+		t.Errorf("unexpected filename %s", child.Filename)
+	}
+	if child.Rating != "questionable" {
+		t.Errorf("expected rating questionable, got %s", child.Rating)
+	}
+}
+
+func TestMoebooruPaginateStopsAtEmptyPage(t *testing.T) {
+	server := newMoebooruFixtureServer(t)
+	defer server.Close()
+
+	err, images, complete := MoebooruSource{SourceName: "yandere", BaseURL: server.URL}.Paginate(Query{Tags: []string{"hatsune_miku"}, MaxPages: DefaultMaxPages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 || !complete {
+		t.Errorf("expected the 2 images of the first page and a complete walk, got %d images", len(images))
+	}
+}
+
+func TestMoebooruPaginateSkipsDeletedPage(t *testing.T) {
+	server := newMoebooruFixtureServer(t)
+	defer server.Close()
+
+	err, images, complete := MoebooruSource{SourceName: "yandere", BaseURL: server.URL}.Paginate(Query{Tags: []string{"deleted"}, MaxPages: DefaultMaxPages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 || !complete {
+		t.Errorf("expected the 2 images of the page after the deleted one and a complete walk, got %d images", len(images))
+	}
+}
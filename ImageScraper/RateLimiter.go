@@ -0,0 +1,207 @@
+package ImageScraper
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket that refills one token per interval and holds up to burst tokens
+type RateLimiter struct {
+	interval time.Duration
+	burst    float64
+	tokens   float64
+	last     time.Time
+	mutex    sync.Mutex
+}
+
+func NewRateLimiter(interval time.Duration, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &RateLimiter{
+		interval: interval,
+		burst:    float64(burst),
+		tokens:   float64(burst),
+		last:     time.Now(),
+	}
+}
+
+// Wait blocks until a token is available and takes it, or until ctx is done
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	l.mutex.Lock()
+	now := time.Now()
+	if l.interval > 0 {
+		l.tokens = math.Min(l.burst, l.tokens+float64(now.Sub(l.last))/float64(l.interval))
+	} else {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	// the token is taken right away, a negative balance makes later callers queue up behind this one
+	l.tokens--
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens * float64(l.interval))
+	}
+	l.mutex.Unlock()
+
+	return sleepContext(ctx, wait)
+}
+
+// sleepContext sleeps for delay, returning the error of ctx early if it is done before
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+var hostLimiters = make(map[string]*RateLimiter)
+var hostLimitersMutex sync.Mutex
+
+var defaultRateInterval = time.Millisecond * 500
+var defaultRateBurst = 2
+
+// SetDefaultRateLimit sets the token bucket used for hosts without their own limit.
+// It only applies to hosts that haven't been requested yet.
+func SetDefaultRateLimit(interval time.Duration, burst int) {
+	hostLimitersMutex.Lock()
+	defer hostLimitersMutex.Unlock()
+
+	defaultRateInterval = interval
+	defaultRateBurst = burst
+}
+
+// SetHostRateLimit limits requests made through doRequest to host to one per interval, with bursts of up to burst requests
+func SetHostRateLimit(host string, interval time.Duration, burst int) {
+	hostLimitersMutex.Lock()
+	defer hostLimitersMutex.Unlock()
+
+	hostLimiters[host] = NewRateLimiter(interval, burst)
+}
+
+func getHostLimiter(host string) *RateLimiter {
+	hostLimitersMutex.Lock()
+	defer hostLimitersMutex.Unlock()
+
+	limiter, ok := hostLimiters[host]
+	if !ok {
+		limiter = NewRateLimiter(defaultRateInterval, defaultRateBurst)
+		hostLimiters[host] = limiter
+	}
+	return limiter
+}
+
+// scraperContext cancels the requests made through doRequest, including their rate limit waits and retry backoffs
+var scraperContext = context.Background()
+
+// SetContext sets the context that cancels all requests of the scrapers, so scrape jobs stop on shutdown
+func SetContext(ctx context.Context) {
+	scraperContext = ctx
+}
+
+var scraperClient = &http.Client{
+	Timeout: time.Second * 10,
+}
+
+// maxRequestAttempts is how often doRequest tries a request before giving up
+const maxRequestAttempts = 5
+
+// retryBaseDelay is the backoff after the first failed attempt, it doubles with every further attempt
+var retryBaseDelay = time.Second
+
+// maxRetryDelay caps both the exponential backoff and Retry-After
+const maxRetryDelay = time.Minute
+
+// doRequest sends req with the shared scraper client, waiting for the rate limiter of the target host first.
+// Network errors, 429 and 5xx responses are retried with exponential backoff, honoring Retry-After.
+// The request must not have a body. Requests without their own context are cancelled with the one passed to SetContext.
+func doRequest(req *http.Request) (*http.Response, error) {
+	if req.Context() == context.Background() {
+		req = req.WithContext(scraperContext)
+	}
+	ctx := req.Context()
+	limiter := getHostLimiter(req.URL.Host)
+
+	for attempt := 1; ; attempt++ {
+		err := limiter.Wait(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := scraperClient.Do(req)
+		if err == nil && res.StatusCode != http.StatusTooManyRequests && res.StatusCode < 500 {
+			return res, nil
+		}
+
+		delay := retryBaseDelay * time.Duration(1<<(attempt-1))
+		if err != nil {
+			log.Warning("Request to ", req.URL.Host, " failed on attempt ", attempt, ": ", err)
+		} else {
+			log.Warning("Request to ", req.URL.Host, " responded with ", res.Status, " on attempt ", attempt)
+			if retryAfter, ok := parseRetryAfter(res.Header.Get("Retry-After")); ok {
+				delay = retryAfter
+			}
+		}
+
+		if attempt == maxRequestAttempts {
+			if err != nil {
+				return nil, err
+			}
+			// the caller checks the status code of the last response
+			return res, nil
+		}
+		if res != nil {
+			_ = res.Body.Close()
+		}
+
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+		log.Debug("Retrying request to ", req.URL.Host, " in ", delay)
+
+		err = sleepContext(ctx, delay)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of seconds or an HTTP date
+func parseRetryAfter(header string) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	date, err := http.ParseTime(header)
+	if err != nil {
+		return 0, false
+	}
+	delay := time.Until(date)
+	if delay < 0 {
+		delay = 0
+	}
+	return delay, true
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"Paktum/Database"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/meilisearch/meilisearch-go"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// importExtensions are the file types that DecodeImage can handle
+var importExtensions = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+	".webp": true,
+	".bmp":  true,
+	".tif":  true,
+	".tiff": true,
+}
+
+// ImportSidecar is the format of .json sidecar files next to imported images
+type ImportSidecar struct {
+	Tags   []string `json:"tags"`
+	Rating string   `json:"rating"`
+}
+
+func ImportMode(sourceDir string, imageDir string, defaultRating string, hardlink bool, options ProcessOptions) {
+	if sourceDir == "" {
+		log.Fatal("No import directory given, set IMPORT_DIR to the directory to import images from")
+	}
+	log.Info("Import mode launching, importing images from ", sourceDir)
+
+	Database.ExecuteMigrations()
+
+	if !isValidRating(defaultRating) {
+		log.Fatal("Invalid import rating ", defaultRating)
+	}
+
+	var paths []string
+	err := filepath.WalkDir(sourceDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			log.Error("Failed to read ", path, ": ", err)
+			return nil
+		}
+		if d.IsDir() || !importExtensions[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		log.Fatal("Failed to walk import directory:", err)
+	}
+	log.Info("Found ", len(paths), " images to import")
+
+	imageCollection := Database.GetMeiliClient().Index("images")
+	budget := NewDecodeBudget(options.DecodeMemory)
+	variants := Database.NewVariantMatcher(Database.GetVariantMaxDistance())
+
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+
+	var docsMutex sync.Mutex
+	docs := make([]Database.ImageEntry, 0, 100)
+	// claimed holds the IDs of the images collected so far, so a file found twice in the import is indexed once
+	claimed := make(map[string]bool)
+	imported := 0
+
+	// flush sends a batch of docs to meili and waits until they are indexed.
+	// It runs outside docsMutex, the other workers keep importing while a batch is indexed.
+	flush := func(batch []Database.ImageEntry) {
+		if len(batch) == 0 {
+			return
+		}
+		taskInfo, err := imageCollection.AddDocuments(batch)
+		if err != nil {
+			log.Error("Failed to add documents to MeiliSearch:", err.Error())
+			removeImportedFiles(imageDir, batch)
+			return
+		}
+		if !Database.WaitForMeilisearchTask(taskInfo) {
+			log.Error("MeiliSearch failed to index image batch of size ", len(batch))
+			removeImportedFiles(imageDir, batch)
+			return
+		}
+
+		docsMutex.Lock()
+		imported += len(batch)
+		docsMutex.Unlock()
+		log.Info("Indexed image batch of size ", len(batch), " in MeiliSearch")
+		attachVariants(variants, batch)
+	}
+
+	for i := 0; i < options.HashWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range jobs {
+				entry, err := importImage(path, imageDir, imageCollection, defaultRating, hardlink, budget)
+				if err != nil {
+					log.Error("Failed to import ", path, ": ", err)
+					continue
+				}
+
+				// the batch is swapped out under the lock and flushed outside it
+				var batch []Database.ImageEntry
+				docsMutex.Lock()
+				if claimed[entry.ID] {
+					docsMutex.Unlock()
+					log.Info("Image ", path, " is a duplicate of another imported image, skipping")
+					continue
+				}
+				claimed[entry.ID] = true
+				docs = append(docs, entry)
+				if len(docs) >= 100 {
+					batch = docs
+					docs = make([]Database.ImageEntry, 0, 100)
+				}
+				docsMutex.Unlock()
+
+				flush(batch)
+			}
+		}()
+	}
+
+	for _, path := range paths {
+		jobs <- path
+	}
+	close(jobs)
+	wg.Wait()
+
+	flush(docs)
+
+	log.Info("Imported ", imported, " of ", len(paths), " images")
+}
+
+func importImage(path string, imageDir string, imageCollection *meilisearch.Index, defaultRating string, hardlink bool, budget *DecodeBudget) (Database.ImageEntry, error) {
+	tags, rating, err := readSidecar(path)
+	if err != nil {
+		return Database.ImageEntry{}, err
+	}
+	if len(tags) == 0 {
+		return Database.ImageEntry{}, errors.New("image has no tags")
+	}
+	if rating == "" {
+		rating = defaultRating
+	}
+	if !isValidRating(rating) {
+		return Database.ImageEntry{}, errors.New("invalid rating " + rating)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return Database.ImageEntry{}, err
+	}
+	defer file.Close()
+
+	hasher := md5.New()
+	size, err := io.Copy(hasher, file)
+	if err != nil {
+		return Database.ImageEntry{}, err
+	}
+	md5sum := hex.EncodeToString(hasher.Sum(nil))
+
+	if imageExists(imageCollection, md5sum) {
+		return Database.ImageEntry{}, errors.New("image " + md5sum + " already exists")
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return Database.ImageEntry{}, err
+	}
+
+	mimeType, err := sniffReader(file)
+	if err != nil {
+		return Database.ImageEntry{}, err
+	}
+	if !strings.HasPrefix(mimeType, "image/") {
+		return Database.ImageEntry{}, errors.New("file is not an image but " + mimeType)
+	}
+
+	err, phash, width, height := HashImage(file, budget)
+	if err != nil {
+		return Database.ImageEntry{}, err
+	}
+
+	filename := md5sum + strings.ToLower(filepath.Ext(path))
+	err = placeImportedFile(path, filepath.Join(imageDir, filename), hardlink)
+	if err != nil {
+		return Database.ImageEntry{}, err
+	}
+
+	return Database.ImageEntry{
+		ID:        md5sum,
+		Tags:      tags,
+		Tagstring: strings.Join(tags, " "),
+		Rating:    Database.Rating(rating),
+		Added:     strconv.FormatUint(uint64(time.Now().Unix()), 10),
+		PHash:     Database.StoredPHash(phash),
+		Size:      int(size),
+		Width:     width,
+		Height:    height,
+		Filename:  filename,
+		MimeType:  mimeType,
+		GroupID:   md5sum,
+		GroupBest: true,
+	}, nil
+}
+
+// removeImportedFiles removes the placed files of images that failed to index, hard links only drop the link
+func removeImportedFiles(imageDir string, batch []Database.ImageEntry) {
+	for _, entry := range batch {
+		err := os.Remove(filepath.Join(imageDir, entry.Filename))
+		if err != nil && !os.IsNotExist(err) {
+			log.Warning("Failed to remove ", entry.Filename, ": ", err)
+		}
+	}
+}
+
+// readSidecar reads the tags and optional rating of an image from "<image>.json", "<image>.txt",
+// or the same files with the image extension replaced.
+// .txt sidecars contain whitespace-separated tags and carry no rating.
+func readSidecar(path string) ([]string, string, error) {
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+
+	for _, candidate := range []string{path + ".json", base + ".json"} {
+		data, err := os.ReadFile(candidate)
+		if err != nil {
+			continue
+		}
+
+		var sidecar ImportSidecar
+		err = json.Unmarshal(data, &sidecar)
+		if err != nil {
+			return nil, "", errors.New("invalid sidecar " + candidate + ": " + err.Error())
+		}
+		return sidecar.Tags, sidecar.Rating, nil
+	}
+
+	for _, candidate := range []string{path + ".txt", base + ".txt"} {
+		data, err := os.ReadFile(candidate)
+		if err != nil {
+			continue
+		}
+		return strings.Fields(string(data)), "", nil
+	}
+
+	return nil, "", errors.New("no sidecar file found")
+}
+
+// placeImportedFile hard-links or copies src to dst.
+// Hard-linking falls back to copying if src and dst are on different filesystems.
+func placeImportedFile(src string, dst string, hardlink bool) error {
+	if hardlink {
+		err := os.Link(src, dst)
+		if err == nil || errors.Is(err, fs.ErrExist) {
+			return nil
+		}
+		log.Debug("Failed to hard-link ", src, ", copying instead: ", err)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	temporaryImageFile, err := os.CreateTemp(filepath.Dir(dst), "temp-paktum-")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(temporaryImageFile, in)
+	if closeErr := temporaryImageFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(temporaryImageFile.Name())
+		return err
+	}
+
+	return os.Rename(temporaryImageFile.Name(), dst)
+}
+
+func isValidRating(rating string) bool {
+	switch Database.Rating(rating) {
+	case Database.RatingExplicit, Database.RatingQuestionable, Database.RatingSafe, Database.RatingGeneral:
+		return true
+	}
+	return false
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"github.com/corona10/goimagehash"
 	log "github.com/sirupsen/logrus"
 	"image"
@@ -8,8 +9,42 @@ import (
 	_ "image/jpeg"
 	_ "image/png"
 	"io"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
 )
 
+// HashImage decodes an image within budget and returns its pHash and dimensions, or an error if it can't be decoded
+func HashImage(r io.ReadSeeker, budget *DecodeBudget) (error, uint64, int, int) {
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return errors.New("failed to decode image config: " + err.Error()), 0, 0, 0
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return errors.New("failed to rewind image: " + err.Error()), 0, 0, 0
+	}
+
+	err = checkImageDimensions(config.Width, config.Height)
+	if err != nil {
+		return err, 0, 0, 0
+	}
+	size := decodedImageSize(config.Width, config.Height)
+	err = budget.Acquire(size)
+	if err != nil {
+		return err, 0, 0, 0
+	}
+	defer budget.Release(size)
+
+	decodedImage := DecodeImage(r)
+	if decodedImage == nil {
+		return errors.New("failed to decode image"), 0, 0, 0
+	}
+
+	return nil, GeneratePHash(decodedImage), decodedImage.Bounds().Dx(), decodedImage.Bounds().Dy()
+}
+
 func DecodeImage(r io.Reader) image.Image {
 	decodedImg, format, err := image.Decode(r)
 	if err != nil {
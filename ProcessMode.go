@@ -3,12 +3,11 @@ package main
 import (
 	"Paktum/Database"
 	"Paktum/ImageScraper"
-	"bytes"
 	"context"
-	"encoding/gob"
-	"github.com/go-redis/redis/v8"
-	"github.com/meilisearch/meilisearch-go"
+	"crypto/rand"
+	"encoding/hex"
 	log "github.com/sirupsen/logrus"
+	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -16,40 +15,72 @@ import (
 	"time"
 )
 
-func ProcessMode(imageDir string) {
-	log.Info("Process mode launching, ingesting data from redis...")
+// ProcessOptions bounds the concurrency of process mode
+type ProcessOptions struct {
+	// DownloadWorkers is the number of images downloaded at once
+	DownloadWorkers int
+	// HashWorkers is the number of images decoded and hashed at once
+	HashWorkers int
+	// DecodeMemory is the approximate number of bytes decoded images may take up at once, 0 disables the limit
+	DecodeMemory int64
+	// MaxFileSize is the largest file in bytes that is downloaded, 0 disables the limit
+	MaxFileSize int64
+}
+
+// maxBatchAttempts is how often meili may fail to index a batch before its images are moved to the dead letter queue
+const maxBatchAttempts = 5
+
+// downloadedImage is an image that has been downloaded and waits to be hashed
+type downloadedImage struct {
+	Image ImageScraper.Image
+	MD5   string
+	Size  int
+}
+
+// ProcessMode processes batches until ctx is cancelled.
+// The batch in progress is indexed as far as it got and requeued if it was interrupted, so no images are lost on shutdown.
+func ProcessMode(ctx context.Context, imageDir string, options ProcessOptions) {
+	log.Info("Process mode launching with ", options.DownloadWorkers, " download and ", options.HashWorkers, " hash workers, ingesting data from the queue...")
 
 	// read data from redis
-	// decode gob
+	// decode payload
 	// process images, check for duplicates
 	// send to meili
 
 	Database.ExecuteMigrations()
 
-	for {
-		// read from redis
-		log.Debug("Sending BLPOP to redis at key paktum:metadata_process")
-		result, err := Database.GetRedis().BLPop(context.TODO(), time.Second*180, "paktum:metadata_process").Result()
-		log.Debug("Received BLPOP response from redis")
+	worker := newWorkerID()
+	log.Info("Processing as worker ", worker)
+	// the heartbeat has to outlive ctx, otherwise the batch in progress could be reclaimed while it is still being finished
+	housekeepingDone := make(chan struct{})
+	defer close(housekeepingDone)
+	go workerHousekeeping(worker, housekeepingDone)
+
+	lanes := Database.NewLaneScheduler(Database.Lanes)
+	budget := NewDecodeBudget(options.DecodeMemory)
+	variants := Database.NewVariantMatcher(Database.GetVariantMaxDistance())
+
+	for ctx.Err() == nil {
+		// claim a batch from the lanes of the queue, it stays in our processing list until it is acknowledged
+		log.Debug("Claiming batch from ", Database.MetadataQueue)
+		lane, payload, err := lanes.Claim(ctx, Database.GetWorkQueue(), worker, time.Second*180)
+		log.Debug("Received claim response from the queue")
 		if err != nil {
-			if err != redis.Nil {
-				log.Error("Error reading from redis:", err.Error())
+			if err != Database.ErrQueueEmpty && ctx.Err() == nil {
+				log.Error("Error reading from the queue:", err.Error())
 			}
 			continue
 		}
+		queue := Database.LaneQueue(lane)
 
-		log.Debug("Got", len(result), "items from redis")
-
-		var images []ImageScraper.Image
-		dec := gob.NewDecoder(bytes.NewBuffer([]byte(result[1])))
-		err = dec.Decode(&images)
+		images, err := Database.DecodeImageBatch([]byte(payload))
 		if err != nil {
-			log.Error("Failed to decode image gob:", err.Error())
+			// a batch that can't be decoded will never succeed, so it is dropped
+			log.Error("Failed to decode image batch:", err.Error())
+			ackBatch(queue, worker, payload)
 			continue
 		}
-		log.Debug("Decoded", len(images), "images")
-
-		var wg sync.WaitGroup
+		log.Debug("Decoded", len(images), "images from lane", lane)
 
 		type ProcessedImages struct {
 			ImageIDs map[string]string
@@ -62,93 +93,352 @@ func ProcessMode(imageDir string) {
 
 		type WrappedMeiliDocs struct {
 			Docs []Database.ImageEntry
+			// Images are the scraped images the docs were created from
+			Images []ImageScraper.Image
 			sync.Mutex
 		}
 		wrappedMeiliDocs := WrappedMeiliDocs{
-			Docs: make([]Database.ImageEntry, 0, len(images)),
+			Docs:   make([]Database.ImageEntry, 0, len(images)),
+			Images: make([]ImageScraper.Image, 0, len(images)),
 		}
 
 		imageCollection := Database.GetMeiliClient().Index("images")
 
-		for _, image := range images {
-			wg.Add(1)
-			go func(image ImageScraper.Image, wg *sync.WaitGroup, imageCollection *meilisearch.Index, processedImages *ProcessedImages, wrappedMeiliDocs *WrappedMeiliDocs) {
-				// check if image already exists
-				// if it does, skip
-				// if it doesn't, download and add to meili
-				defer wg.Done()
+		// images are downloaded and hashed by two pools, so slow downloads don't hold up the CPU-bound hashing and vice versa
+		downloads := make(chan ImageScraper.Image)
+		hashes := make(chan downloadedImage)
+		var downloadWg, hashWg sync.WaitGroup
 
-				md5 := strings.TrimSuffix(image.Filename, filepath.Ext(image.Filename))
+		for i := 0; i < options.DownloadWorkers; i++ {
+			downloadWg.Add(1)
+			go func() {
+				defer downloadWg.Done()
+				for image := range downloads {
+					// check if image already exists
+					// if it does, skip
+					// if it doesn't, download it and pass it on for hashing
+					md5 := strings.TrimSuffix(image.Filename, filepath.Ext(image.Filename))
 
-				processedImages.mutex.Lock()
-				if _, ok := processedImages.ImageIDs[md5]; ok {
+					processedImages.mutex.Lock()
+					if _, ok := processedImages.ImageIDs[md5]; ok {
+						processedImages.mutex.Unlock()
+						log.Info("Found MD5 already being processed, duplicate image in queue, skipping...")
+						continue
+					}
+					if imageExists(imageCollection, md5) {
+						processedImages.mutex.Unlock()
+						log.Info("Image", md5, "already exists, skipping...")
+						continue
+					}
+					processedImages.ImageIDs[md5] = image.Filename
 					processedImages.mutex.Unlock()
-					log.Info("Found MD5 already being processed, duplicate image in queue, skipping...")
-					return
-				}
-				if imageExists(imageCollection, md5) {
-					processedImages.mutex.Unlock()
-					log.Info("Image", md5, "already exists, skipping...")
-					return
-				}
-				processedImages.ImageIDs[md5] = image.Filename
-				processedImages.mutex.Unlock()
 
-				if len(md5) != 32 {
-					log.Error("MD5 is not 32 characters long, skipping...")
-					return
+					if reason := validateImage(image, md5); reason != "" {
+						log.Error("Image ", image.ID, " is invalid (", reason, "), skipping...")
+						deadLetter(image, reason)
+						continue
+					}
+
+					err, size := downloadImage(ctx, image.FileURL, imageDir, md5+filepath.Ext(image.Filename), md5, options.MaxFileSize)
+					if err != nil {
+						log.Error("Failed to download image", image.Filename)
+						// downloads aborted by a shutdown are retried with the requeued batch
+						if ctx.Err() == nil {
+							deadLetter(image, "failed to download image: "+err.Error())
+						}
+						continue
+					}
+
+					hashes <- downloadedImage{Image: image, MD5: md5, Size: size}
 				}
+			}()
+		}
+
+		for i := 0; i < options.HashWorkers; i++ {
+			hashWg.Add(1)
+			go func() {
+				defer hashWg.Done()
+				for downloaded := range hashes {
+					image := downloaded.Image
+					filename := downloaded.MD5 + filepath.Ext(image.Filename)
+
+					// the type is detected from the content, the extension of the source can't be trusted
+					mimeType, err := sniffFile(imageDir + filename)
+					if err != nil {
+						log.Error("Failed to read image", filename)
+						deadLetter(image, "failed to read image: "+err.Error())
+						removeDownloadedImage(imageDir, filename)
+						continue
+					}
+					if !isSupportedMIMEType(mimeType) {
+						log.Error("Image ", filename, " has unsupported type ", mimeType)
+						deadLetter(image, "unsupported file type "+mimeType)
+						removeDownloadedImage(imageDir, filename)
+						continue
+					}
+
+					var phash uint64
+					var width, height int
+					var video VideoMetadata
+					if isVideoMIMEType(mimeType) {
+						// videos are hashed by their poster frame
+						err, video, phash = processVideo(ctx, imageDir, filename, budget)
+						width, height = video.Width, video.Height
+					} else {
+						err, phash, width, height = hashImageFile(imageDir, filename, budget)
+					}
+					if err != nil {
+						log.Error("Failed to hash image", filename)
+						// videos cut off by a shutdown are retried with the requeued batch
+						if ctx.Err() == nil {
+							deadLetter(image, "failed to hash image: "+err.Error())
+						}
+						removeDownloadedImage(imageDir, filename)
+						continue
+					}
+
+					uploaded := ""
+					if image.Uploaded != 0 {
+						uploaded = strconv.FormatInt(image.Uploaded, 10)
+					}
+
+					wrappedMeiliDocs.Lock()
+					wrappedMeiliDocs.Docs = append(wrappedMeiliDocs.Docs, Database.ImageEntry{
+						ID:        downloaded.MD5,
+						URL:       image.FileURL,
+						Tags:      image.Tags,
+						Tagstring: strings.Join(image.Tags, " "),
+						Rating:    Database.Rating(image.Rating),
+						Added:     strconv.FormatUint(uint64(time.Now().Unix()), 10),
+						PHash:     Database.StoredPHash(phash),
+						Size:      downloaded.Size,
+						Width:     width,
+						Height:    height,
+						Filename:  filename,
+						MimeType:  mimeType,
+
+						Duration:   video.Duration,
+						VideoCodec: video.Codec,
+						HasAudio:   video.HasAudio,
+						Poster:     video.Poster,
 
-				if len(image.Tags) == 0 {
-					log.Error("Image has no tags, skipping...")
-					return
+						SourceName:    image.Source,
+						SourcePostID:  image.ID,
+						SourceURL:     image.PageURL,
+						ArtworkSource: image.ArtworkSource,
+						Score:         image.Score,
+						Uploaded:      uploaded,
+						ParentID:      image.ParentID,
+						GroupID:       downloaded.MD5,
+						GroupBest:     true,
+					})
+					wrappedMeiliDocs.Images = append(wrappedMeiliDocs.Images, image)
+					wrappedMeiliDocs.Unlock()
 				}
+			}()
+		}
+
+	feed:
+		for _, image := range images {
+			select {
+			case downloads <- image:
+			case <-ctx.Done():
+				break feed
+			}
+		}
+		close(downloads)
+		downloadWg.Wait()
+		close(hashes)
+		hashWg.Wait()
+		interrupted := ctx.Err() != nil
+		log.Info("Finished processing image batch.")
 
-				if image.Rating != "explicit" && image.Rating != "questionable" && image.Rating != "safe" && image.Rating != "general" {
-					log.Error("Image has no rating, skipping...")
-					return
+		if len(wrappedMeiliDocs.Docs) > 0 {
+			// add to meili, the batch is only acknowledged once meili has stored the documents
+			taskInfo, err := imageCollection.AddDocuments(wrappedMeiliDocs.Docs)
+			if err != nil || !Database.WaitForMeilisearchTask(taskInfo) {
+				reason := "MeiliSearch failed to index the batch"
+				if err != nil {
+					reason += ": " + err.Error()
 				}
 
-				if image.FileURL == "" {
-					log.Error("Image has malformed file URL ", image.FileURL, " , skipping...")
-					return
+				attempts, attemptsErr := Database.AddBatchAttempt(payload)
+				if attemptsErr != nil {
+					log.Error("Failed to count attempts of batch: ", attemptsErr)
+				}
+				if attempts >= maxBatchAttempts {
+					log.Error(reason, " on ", attempts, " attempts, moving its images to the dead letter queue")
+					for _, image := range wrappedMeiliDocs.Images {
+						deadLetter(image, reason)
+					}
+					clearBatchAttempts(payload)
+					ackBatch(queue, worker, payload)
+					continue
 				}
 
-				err, phash, size, width, height := downloadImage(image.FileURL, imageDir, md5+filepath.Ext(image.Filename))
+				log.Error(reason, " on attempt ", attempts, ", requeueing batch")
+				err = Database.GetWorkQueue().Requeue(queue, worker, payload)
 				if err != nil {
-					log.Error("Failed to download image", image.Filename)
-					return
+					log.Error("Failed to requeue batch: ", err)
 				}
+				// give meili some time to recover before the batch is claimed again
+				time.Sleep(time.Second * 5)
+				continue
+			}
+			clearBatchAttempts(payload)
+		}
+		log.Info("Sent image batch of size", len(wrappedMeiliDocs.Docs), "to MeiliSearch")
+		attachVariants(variants, wrappedMeiliDocs.Docs)
+		err = Database.ClearImageAttempts(wrappedMeiliDocs.Images)
+		if err != nil {
+			log.Error("Failed to clear attempts of indexed images: ", err)
+		}
 
-				wrappedMeiliDocs.Lock()
-				wrappedMeiliDocs.Docs = append(wrappedMeiliDocs.Docs, Database.ImageEntry{
-					ID:        md5,
-					URL:       image.FileURL,
-					Tags:      image.Tags,
-					Tagstring: strings.Join(image.Tags, " "),
-					Rating:    Database.Rating(image.Rating),
-					Added:     strconv.FormatUint(uint64(time.Now().Unix()), 10),
-					PHash:     phash,
-					Size:      size,
-					Width:     width,
-					Height:    height,
-					Filename:  md5 + filepath.Ext(image.Filename),
-				})
-				wrappedMeiliDocs.Unlock()
-
-			}(image, &wg, imageCollection, &processedImages, &wrappedMeiliDocs)
-		}
-
-		wg.Wait()
-		log.Info("Finished processing image batch.")
-
-		if len(wrappedMeiliDocs.Docs) > 0 {
-			// add to meili
-			_, err = imageCollection.AddDocuments(wrappedMeiliDocs.Docs)
+		if interrupted {
+			// the indexed images are skipped as existing when the batch is processed again
+			log.Info("Shutting down, requeueing interrupted batch")
+			err = Database.GetWorkQueue().Requeue(queue, worker, payload)
 			if err != nil {
-				log.Error("Failed to add documents to MeiliSearch:", err.Error())
+				log.Error("Failed to requeue batch: ", err)
+			}
+			break
+		}
+		ackBatch(queue, worker, payload)
+	}
+
+	log.Info("Process mode stopped")
+}
+
+// validateImage returns why a scraped image can't be indexed, or an empty string if it can
+func validateImage(image ImageScraper.Image, md5 string) string {
+	if len(md5) != 32 {
+		return "MD5 is not 32 characters long"
+	}
+	if len(image.Tags) == 0 {
+		return "image has no tags"
+	}
+	if image.Rating != "explicit" && image.Rating != "questionable" && image.Rating != "safe" && image.Rating != "general" {
+		return "image has no valid rating: " + image.Rating
+	}
+	if image.FileURL == "" {
+		return "image has malformed file URL"
+	}
+	return ""
+}
+
+// deadLetter moves an image that failed to process to the dead letter queue, where it can be inspected and retried
+func deadLetter(image ImageScraper.Image, reason string) {
+	err := Database.AddDeadLetter(image, reason)
+	if err != nil {
+		log.Error("Failed to add image ", image.ID, " to dead letter queue: ", err)
+	}
+}
+
+// removeDownloadedImage removes a downloaded image that won't be indexed, along with the poster extracted from it if it is a video
+func removeDownloadedImage(imageDir string, filename string) {
+	for _, name := range []string{filename, posterFilename(filename)} {
+		err := os.Remove(filepath.Join(imageDir, name))
+		if err != nil && !os.IsNotExist(err) {
+			log.Warning("Failed to remove ", name, ": ", err)
+		}
+	}
+}
+
+// attachVariants adds indexed images to the groups of their variants and writes the groups onto their documents,
+// so they show up as related without waiting for cleanup mode.
+// Failures are only logged, the next run of cleanup mode puts the images into their groups.
+func attachVariants(variants *Database.VariantMatcher, docs []Database.ImageEntry) {
+	if len(docs) == 0 {
+		return
+	}
+
+	candidates := make([]Database.VariantCandidate, 0, len(docs))
+	for _, doc := range docs {
+		candidates = append(candidates, Database.ImageEntryToVariantCandidate(doc))
+	}
+
+	changed, err := variants.Attach(candidates)
+	if err != nil {
+		log.Error("Failed to attach images to variant groups: ", err)
+		return
+	}
+	if len(changed) == 0 {
+		return
+	}
+
+	// every member is updated, since merging groups changes the group of the members of all but one of them, and may change the best one
+	groups := make(map[string]Database.ImageGroup)
+	for _, group := range changed {
+		for _, member := range group.Members {
+			groups[member.ID] = Database.ImageGroup{ID: group.ID, Best: member.ID == group.Best}
+		}
+	}
+	err = Database.UpdateImageGroups(groups)
+	if err != nil {
+		log.Error("Failed to update the group of images: ", err)
+		return
+	}
+	log.Info("Attached images to ", len(changed), " variant groups")
+}
+
+func ackBatch(queue string, worker string, payload string) {
+	err := Database.GetWorkQueue().Ack(queue, worker, payload)
+	if err != nil {
+		log.Error("Failed to acknowledge batch: ", err)
+	}
+}
+
+func clearBatchAttempts(payload string) {
+	err := Database.ClearBatchAttempts(payload)
+	if err != nil {
+		log.Error("Failed to clear attempts of batch: ", err)
+	}
+}
+
+// newWorkerID returns an ID that is unique to this process, so a restarted worker never picks up a processing list it lost track of
+func newWorkerID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "worker"
+	}
+
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+
+	return hostname + "-" + hex.EncodeToString(suffix)
+}
+
+// workerHousekeeping keeps the heartbeat of worker alive and returns batches of dead workers to the queue until done is closed
+func workerHousekeeping(worker string, done chan struct{}) {
+	heartbeatTicker := time.NewTicker(Database.WorkerHeartbeatTTL / 3)
+	defer heartbeatTicker.Stop()
+	reclaimTicker := time.NewTicker(Database.WorkerHeartbeatTTL * 2)
+	defer reclaimTicker.Stop()
+
+	beat := func() {
+		err := Database.GetWorkQueue().Heartbeat(worker)
+		if err != nil {
+			log.Error("Failed to send worker heartbeat: ", err)
+		}
+	}
+	beat()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-heartbeatTicker.C:
+			beat()
+		case <-reclaimTicker.C:
+			for _, lane := range Database.Lanes {
+				reclaimed, err := Database.GetWorkQueue().ReclaimStale(Database.LaneQueue(lane.Name))
+				if err != nil {
+					log.Error("Failed to reclaim stale batches of lane ", lane.Name, ": ", err)
+				}
+				if reclaimed > 0 {
+					log.Info("Reclaimed ", reclaimed, " batches of dead workers in lane ", lane.Name)
+				}
 			}
 		}
-		log.Info("Sent image batch of size", len(wrappedMeiliDocs.Docs), "to MeiliSearch")
 	}
 }
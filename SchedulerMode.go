@@ -0,0 +1,105 @@
+package main
+
+import (
+	"Paktum/Database"
+	"Paktum/ImageScraper"
+	"context"
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"time"
+)
+
+// schedulerPollInterval is how often the scheduler checks for due subscriptions
+const schedulerPollInterval = time.Second * 30
+
+// SchedulerMode runs the tag subscriptions once they are due, until ctx is done
+func SchedulerMode(ctx context.Context, jitter time.Duration, workers int) {
+	log.Info("Scheduler mode launching with ", workers, " workers, polling subscriptions every ", schedulerPollInterval)
+
+	rand.Seed(time.Now().UnixNano())
+
+	jobs := make(chan Database.TagSubscription)
+	finished := make(chan string)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for subscription := range jobs {
+				runSubscription(subscription, jitter)
+				finished <- subscription.ID
+			}
+		}()
+	}
+
+	// subscriptions that are queued or running, so slow runs aren't enqueued a second time
+	pending := make(map[string]bool)
+	var queue []Database.TagSubscription
+
+	ticker := time.NewTicker(schedulerPollInterval)
+	defer ticker.Stop()
+
+	enqueueDue := func() {
+		subscriptions, err := Database.GetTagSubscriptions()
+		if err != nil {
+			log.Error("Failed to get subscriptions: ", err)
+			return
+		}
+
+		now := time.Now().Unix()
+		for _, subscription := range subscriptions {
+			if subscription.NextRun > now || pending[subscription.ID] {
+				continue
+			}
+			log.Info("Enqueueing subscription ", subscription.ID, ": ", subscription.Query)
+			pending[subscription.ID] = true
+			queue = append(queue, subscription)
+		}
+	}
+	enqueueDue()
+
+	for {
+		// only offer a job to the workers while there is one queued
+		var next chan Database.TagSubscription
+		var nextJob Database.TagSubscription
+		if len(queue) > 0 {
+			next = jobs
+			nextJob = queue[0]
+		}
+
+		select {
+		case next <- nextJob:
+			queue = queue[1:]
+		case id := <-finished:
+			delete(pending, id)
+		case <-ticker.C:
+			enqueueDue()
+		case <-ctx.Done():
+			log.Info("Scheduler mode stopping")
+			return
+		}
+	}
+}
+
+// runSubscription scrapes a subscription and records the run along with its next due time
+func runSubscription(subscription Database.TagSubscription, jitter time.Duration) {
+	startTime := time.Now()
+
+	err, query := ImageScraper.ParseQuery(subscription.Query)
+	if err == nil {
+		err = runScrapeJob(query, Database.LaneSubscription)
+	}
+	if err != nil {
+		log.Error("Subscription ", subscription.ID, " failed: ", err)
+	} else {
+		log.Info("Subscription ", subscription.ID, " finished in ", time.Since(startTime))
+	}
+
+	nextRun := startTime.Add(time.Duration(subscription.Interval) * time.Second)
+	if jitter > 0 {
+		nextRun = nextRun.Add(time.Duration(rand.Int63n(int64(jitter))))
+	}
+
+	err = Database.RecordTagSubscriptionRun(subscription.ID, startTime.Unix(), nextRun.Unix(), err)
+	if err != nil {
+		log.Error("Failed to record run of subscription ", subscription.ID, ": ", err)
+	}
+}
@@ -4,75 +4,145 @@ import (
 	"Paktum/Database"
 	"Paktum/ImageScraper"
 	"bufio"
-	"bytes"
-	"context"
-	"encoding/gob"
+	"errors"
 	"github.com/schollz/progressbar/v3"
 	log "github.com/sirupsen/logrus"
 	"os"
 	"strings"
 )
 
-func ScrapeMode() {
-	log.Info("Scraping mode launching")
+func ScrapeMode(workers int, lane string) {
+	log.Info("Scraping mode launching with ", workers, " workers, queueing into lane ", lane)
 
 	// read from stdin until EOF
-	// for each line, add the space-seperated tags into an array
-	// call scrape with the array
+	// for each line, parse the optional source prefix and the space-seperated tags into a query
+	// call scrape with the query, at most workers queries at once
 
-	tags := readStdinTagsIntoArray()
+	queries := readStdinQueriesIntoArray()
 
-	progress := make(chan int, len(tags))
-	pbar := progressbar.Default(int64(len(tags)), "Fetch tag metadata...")
+	jobs := make(chan ImageScraper.Query)
+	progress := make(chan int, len(queries))
+	pbar := progressbar.Default(int64(len(queries)), "Fetch tag metadata...")
 
-	for _, tag := range tags {
-		go func(tag []string) {
-			err, images := ImageScraper.Scrape(tag)
-			if err != nil {
-				log.Error(err)
-				progress <- 1
-				return
-			}
-
-			for _, imageBatch := range images {
-				//encode image array into gob and send to redis
-				var buf bytes.Buffer
-				enc := gob.NewEncoder(&buf)
-				err = enc.Encode(imageBatch)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for query := range jobs {
+				err := runScrapeJob(query, lane)
 				if err != nil {
 					log.Error(err)
-					progress <- 1
-					return
 				}
 
-				log.Info("Sending ", len(imageBatch), " images to redis")
-				_, err = Database.GetRedis().RPush(context.Background(), "paktum:metadata_process", buf.Bytes()).Result()
-				if err != nil {
-					log.Error("Failed to push data to redis:", err)
-					continue
-				}
+				progress <- 1
 			}
-
-			progress <- 1
-		}(tag)
+		}()
 	}
 
-	// wait for all goroutines to finish
-	for i := 0; i < len(tags); i++ {
+	go func() {
+		for _, query := range queries {
+			jobs <- query
+		}
+		close(jobs)
+	}()
+
+	// wait for all queries to finish
+	for i := 0; i < len(queries); i++ {
 		<-progress
 		_ = pbar.Add(1)
 	}
 }
 
-func readStdinTagsIntoArray() [][]string {
+// runScrapeJob scrapes all posts of query that are newer than its checkpoint and sends them to the queue.
+// The batches go into the lane of the query, or defaultLane if it doesn't set one.
+// The checkpoint is only moved forward once every batch has been queued and the walk reached the old checkpoint or the end of the results,
+// otherwise the posts between the old checkpoint and the ones scraped now would be skipped by the next run.
+// A query without a checkpoint gets its first one even if the walk was cut short, so the next runs are incremental.
+// Queries that aren't sorted newest first are scraped without checkpoints.
+func runScrapeJob(query ImageScraper.Query, defaultLane string) error {
+	lane := defaultLane
+	if query.Lane != "" {
+		lane = query.Lane
+	}
+	if !Database.IsLane(lane) {
+		return errors.New("unknown lane " + lane)
+	}
+
+	checkpointed := query.NewestFirst()
+	if !checkpointed {
+		log.Debug("Scraping ", query.Key(), " without checkpoint because it changes the post order")
+	} else if !query.IgnoreCheckpoint {
+		checkpoint, err := Database.GetScrapeCheckpoint(query.Key())
+		if err != nil {
+			log.Error("Failed to read checkpoint of ", query.Key(), ", scraping without it: ", err)
+		}
+		query.SinceID = checkpoint
+		log.Debug("Scraping ", query.Key(), " from checkpoint ", checkpoint)
+	}
+
+	err, images, complete := ImageScraper.Scrape(query)
+	if err != nil {
+		return err
+	}
+
+	queued := true
+	for _, imageBatch := range images {
+		//encode image array into a payload envelope and send it to the queue
+		payload, err := Database.EncodeImageBatch(imageBatch)
+		if err != nil {
+			return err
+		}
+
+		log.Info("Sending ", len(imageBatch), " images to the queue")
+		err = Database.GetWorkQueue().Push(Database.LaneQueue(lane), string(payload))
+		if err != nil {
+			log.Error("Failed to push data to the queue:", err)
+			queued = false
+			continue
+		}
+	}
+
+	if !checkpointed {
+		return nil
+	}
+	if !queued {
+		log.Warning("Not updating checkpoint of ", query.Key(), " because some batches failed to queue")
+		return nil
+	}
+	// without an old checkpoint there is nothing to skip, and the first one lets later runs stop early even if this one was cut short
+	if !complete && query.SinceID != 0 {
+		log.Info("Not updating checkpoint of ", query.Key(), " because the page or post limit was reached before the old checkpoint")
+		return nil
+	}
+
+	highestID := ImageScraper.HighestID(images)
+	if highestID == 0 {
+		return nil
+	}
+	err = Database.SetScrapeCheckpoint(query.Key(), highestID)
+	if err != nil {
+		log.Error("Failed to store checkpoint of ", query.Key(), ": ", err)
+	}
+
+	return nil
+}
+
+func readStdinQueriesIntoArray() []ImageScraper.Query {
 	reader := bufio.NewReader(os.Stdin)
-	var tags [][]string
+	var queries []ImageScraper.Query
 	for {
 		text, err := reader.ReadString('\n')
 		if err != nil {
 			break
 		}
-		tags = append(tags, strings.Split(strings.TrimSpace(text), " "))
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+
+		err, query := ImageScraper.ParseQuery(text)
+		if err != nil {
+			log.Error("Skipping invalid query ", strings.TrimSpace(text), ": ", err)
+			continue
+		}
+		queries = append(queries, query)
 	}
-	return tags
+	return queries
 }
@@ -16,6 +16,7 @@ import (
 	"io/fs"
 	"math/rand"
 	"net/http"
+	"os"
 	"strconv"
 	"time"
 )
@@ -32,7 +33,8 @@ func getFrontendFS() http.FileSystem {
 	return http.FS(fsys)
 }
 
-func ServerMode(imageDir string) {
+// ServerMode serves the API until ctx is cancelled, then waits up to shutdownTimeout for in-flight requests to finish
+func ServerMode(ctx context.Context, imageDir string, shutdownTimeout time.Duration) {
 
 	rand.Seed(time.Now().UnixNano())
 	r := gin.Default()
@@ -59,7 +61,7 @@ func ServerMode(imageDir string) {
 			return
 		}
 
-		images, resultCount, err := Database.SearchImages(query, limit, true, "")
+		images, resultCount, err := Database.SearchImages(query, limit, true, "", false)
 		if err != nil {
 			return
 		}
@@ -130,10 +132,35 @@ func ServerMode(imageDir string) {
 		c.FileFromFS(c.Request.URL.Path, getFrontendFS())
 	})
 
-	err := r.Run()
+	// listen on the same address r.Run() would use
+	addr := ":8080"
+	if port := os.Getenv("PORT"); port != "" {
+		addr = ":" + port
+	}
+	server := &http.Server{
+		Addr:    addr,
+		Handler: r,
+	}
+
+	go func() {
+		log.Info("Listening and serving HTTP on ", addr)
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal("Failed to start server:", err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Info("Shutting down server, waiting up to ", shutdownTimeout, " for in-flight requests")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err := server.Shutdown(shutdownCtx)
 	if err != nil {
-		log.Fatal("Failed to start server:", err)
-	} // listen and serve on
+		log.Error("Server didn't shut down cleanly: ", err)
+		return
+	}
+	log.Info("Server stopped")
 }
 
 // Defining the Playground handler
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+)
+
+// MIMETypeUnknown is reported for files whose magic bytes aren't recognized
+const MIMETypeUnknown = "application/octet-stream"
+
+// sniffLength is the number of leading bytes SniffMIMEType looks at
+const sniffLength = 16
+
+// magicSignature matches a file type by its leading bytes, a '?' in the signature matches any byte
+type magicSignature struct {
+	mimeType  string
+	signature string
+	// brands restricts ISO base media files to these major brands, AVIF, HEIC and QuickTime share the "ftyp" box with MP4
+	brands []string
+}
+
+var magicSignatures = []magicSignature{
+	{"image/jpeg", "\xff\xd8\xff", nil},
+	{"image/png", "\x89PNG\r\n\x1a\n", nil},
+	{"image/gif", "GIF87a", nil},
+	{"image/gif", "GIF89a", nil},
+	{"image/webp", "RIFF????WEBP", nil},
+	{"image/bmp", "BM", nil},
+	{"image/tiff", "II*\x00", nil},
+	{"image/tiff", "MM\x00*", nil},
+	{"video/webm", "\x1a\x45\xdf\xa3", nil},
+	{"video/mp4", "????ftyp", []string{"isom", "iso2", "iso4", "iso5", "iso6", "mp41", "mp42", "avc1", "dash", "mmp4", "M4V ", "MSNV"}},
+}
+
+// SniffMIMEType detects the type of a file from its magic bytes, independent of its file name
+func SniffMIMEType(header []byte) string {
+	for _, magic := range magicSignatures {
+		if matchesSignature(header, magic.signature) && matchesBrand(header, magic.brands) {
+			return magic.mimeType
+		}
+	}
+	return MIMETypeUnknown
+}
+
+// matchesBrand checks the major brand that follows the "ftyp" box type, any header matches if brands is empty
+func matchesBrand(header []byte, brands []string) bool {
+	if len(brands) == 0 {
+		return true
+	}
+	if len(header) < 12 {
+		return false
+	}
+	for _, brand := range brands {
+		if string(header[8:12]) == brand {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesSignature(header []byte, signature string) bool {
+	if len(header) < len(signature) {
+		return false
+	}
+	for i := 0; i < len(signature); i++ {
+		if signature[i] != '?' && signature[i] != header[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sniffReader detects the type of r and rewinds it
+func sniffReader(r io.ReadSeeker) (string, error) {
+	header := make([]byte, sniffLength)
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+	return SniffMIMEType(header[:n]), nil
+}
+
+// sniffFile detects the type of the file at path
+func sniffFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	return sniffReader(file)
+}
+
+// isSupportedMIMEType reports whether files of mimeType can be hashed and indexed
+func isSupportedMIMEType(mimeType string) bool {
+	return strings.HasPrefix(mimeType, "image/") || isVideoMIMEType(mimeType)
+}
+
+func isVideoMIMEType(mimeType string) bool {
+	return strings.HasPrefix(mimeType, "video/")
+}
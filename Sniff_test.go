@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestSniffMIMEType(t *testing.T) {
+	tests := map[string]string{
+		"\xff\xd8\xff\xe0\x00\x10JFIF":          "image/jpeg",
+		"\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR": "image/png",
+		"GIF89a\x01\x00":                        "image/gif",
+		"RIFF\x24\x00\x00\x00WEBPVP8 ":          "image/webp",
+		"BM\x36\x00\x00\x00":                    "image/bmp",
+		"II*\x00\x08\x00\x00\x00":               "image/tiff",
+		"MM\x00*\x00\x00\x00\x08":               "image/tiff",
+		"\x1a\x45\xdf\xa3\x9f\x42\x86\x81":      "video/webm",
+		"\x00\x00\x00\x18ftypmp42":              "video/mp4",
+		"\x00\x00\x00\x20ftypisom":              "video/mp4",
+		"\x00\x00\x00\x1cftypavif":              MIMETypeUnknown,
+		"\x00\x00\x00\x18ftypheic":              MIMETypeUnknown,
+		"\x00\x00\x00\x14ftypqt  ":              MIMETypeUnknown,
+		"\x00\x00\x00\x18ftyp":                  MIMETypeUnknown,
+		"<!DOCTYPE html>":                       MIMETypeUnknown,
+		"":                                      MIMETypeUnknown,
+	}
+
+	for header, expected := range tests {
+		if mimeType := SniffMIMEType([]byte(header)); mimeType != expected {
+			t.Errorf("expected %s for %q, got %s", expected, header, mimeType)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ffmpegPath = "ffmpeg"
+var ffprobePath = "ffprobe"
+
+// videoTimeout limits the time ffprobe and ffmpeg may take for a single video, so a broken file can't hold up a hash worker
+const videoTimeout = time.Minute * 2
+
+// SetVideoTools sets the ffmpeg and ffprobe binaries, bare names are looked up in PATH
+func SetVideoTools(ffmpeg string, ffprobe string) {
+	ffmpegPath = ffmpeg
+	ffprobePath = ffprobe
+}
+
+// VideoMetadata is what ffprobe reports about a video, along with the poster frame extracted from it
+type VideoMetadata struct {
+	// Duration in seconds
+	Duration float64
+	Codec    string
+	Width    int
+	Height   int
+	HasAudio bool
+	// Poster is the filename of the poster JPEG next to the video
+	Poster string
+}
+
+// ffprobeOutput is the part of `ffprobe -print_format json -show_format -show_streams` we use
+type ffprobeOutput struct {
+	Streams []struct {
+		CodecType string `json:"codec_type"`
+		CodecName string `json:"codec_name"`
+		Width     int    `json:"width"`
+		Height    int    `json:"height"`
+	} `json:"streams"`
+	Format struct {
+		Duration string `json:"duration"`
+	} `json:"format"`
+}
+
+// posterFilename returns the filename of the poster JPEG of a video
+func posterFilename(filename string) string {
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + ".poster.jpg"
+}
+
+func parseFFprobeOutput(output []byte) (VideoMetadata, error) {
+	var probe ffprobeOutput
+	err := json.Unmarshal(output, &probe)
+	if err != nil {
+		return VideoMetadata{}, err
+	}
+
+	var metadata VideoMetadata
+	hasVideo := false
+	for _, stream := range probe.Streams {
+		switch stream.CodecType {
+		case "video":
+			// the first video stream is the one players show
+			if !hasVideo {
+				hasVideo = true
+				metadata.Codec = stream.CodecName
+				metadata.Width = stream.Width
+				metadata.Height = stream.Height
+			}
+		case "audio":
+			metadata.HasAudio = true
+		}
+	}
+	if !hasVideo {
+		return VideoMetadata{}, errors.New("file has no video stream")
+	}
+
+	if probe.Format.Duration != "" {
+		metadata.Duration, err = strconv.ParseFloat(probe.Format.Duration, 64)
+		if err != nil {
+			return VideoMetadata{}, fmt.Errorf("invalid duration %q: %w", probe.Format.Duration, err)
+		}
+	}
+
+	return metadata, nil
+}
+
+// probeVideo runs ffprobe on the video at path, it is killed once ctx is done
+func probeVideo(ctx context.Context, path string) (VideoMetadata, error) {
+	cmd := exec.CommandContext(ctx, ffprobePath, "-v", "error", "-print_format", "json", "-show_format", "-show_streams", path)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return VideoMetadata{}, fmt.Errorf("ffprobe failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return parseFFprobeOutput(stdout.Bytes())
+}
+
+// extractPoster writes the frame at the given second of the video at path as JPEG to posterPath, ffmpeg is killed once ctx is done
+func extractPoster(ctx context.Context, path string, posterPath string, at float64) error {
+	cmd := exec.CommandContext(ctx, ffmpegPath, "-v", "error", "-y", "-ss", strconv.FormatFloat(at, 'f', 3, 64), "-i", path, "-frames:v", "1", "-q:v", "2", "-f", "image2", "-c:v", "mjpeg", posterPath)
+	log.Trace(cmd.Path, cmd.Args)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("ffmpeg failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+/* processVideo probes a downloaded video, saves its poster frame next to it and hashes the poster
+ * @param ctx Cancels ffprobe and ffmpeg, which are also stopped after videoTimeout
+ * @param imageDir The directory the video is stored in
+ * @param filename The filename of the video
+ * @param budget Limits the memory of the decoded poster
+ * @return A possible error, the metadata of the video and the pHash of its poster
+ */
+func processVideo(ctx context.Context, imageDir string, filename string, budget *DecodeBudget) (error, VideoMetadata, uint64) {
+	path := filepath.Join(imageDir, filename)
+
+	ctx, cancel := context.WithTimeout(ctx, videoTimeout)
+	defer cancel()
+
+	metadata, err := probeVideo(ctx, path)
+	if err != nil {
+		return err, VideoMetadata{}, 0
+	}
+
+	// the very first frame is often black, so the poster is taken a bit into the video
+	at := 0.0
+	if metadata.Duration > 1 {
+		at = metadata.Duration / 10
+	}
+
+	poster := posterFilename(filename)
+	err = extractPoster(ctx, path, filepath.Join(imageDir, poster), at)
+	if err != nil && at > 0 && ctx.Err() == nil {
+		log.Warning("Failed to extract poster of ", filename, " at ", at, "s, falling back to the first frame: ", err)
+		err = extractPoster(ctx, path, filepath.Join(imageDir, poster), 0)
+	}
+	if err != nil {
+		return err, VideoMetadata{}, 0
+	}
+	metadata.Poster = poster
+
+	file, err := os.Open(filepath.Join(imageDir, poster))
+	if err != nil {
+		return err, VideoMetadata{}, 0
+	}
+	defer file.Close()
+
+	err, phash, _, _ := HashImage(file, budget)
+	if err != nil {
+		return err, VideoMetadata{}, 0
+	}
+	return nil, metadata, phash
+}
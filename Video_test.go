@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestParseFFprobeOutput(t *testing.T) {
+	output := []byte(`{
+		"streams": [
+			{"index": 0, "codec_name": "h264", "codec_type": "video", "width": 1920, "height": 1080},
+			{"index": 1, "codec_name": "aac", "codec_type": "audio"}
+		],
+		"format": {"format_name": "mov,mp4,m4a,3gp,3g2,mj2", "duration": "12.345000"}
+	}`)
+
+	metadata, err := parseFFprobeOutput(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Codec != "h264" || metadata.Width != 1920 || metadata.Height != 1080 {
+		t.Errorf("unexpected video stream %+v", metadata)
+	}
+	if !metadata.HasAudio {
+		t.Error("expected the audio stream to be detected")
+	}
+	if metadata.Duration != 12.345 {
+		t.Errorf("expected duration 12.345, got %f", metadata.Duration)
+	}
+}
+
+func TestParseFFprobeOutputWithoutAudio(t *testing.T) {
+	output := []byte(`{"streams": [{"codec_name": "vp9", "codec_type": "video", "width": 640, "height": 360}], "format": {"duration": "3.0"}}`)
+
+	metadata, err := parseFFprobeOutput(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.HasAudio || metadata.Codec != "vp9" {
+		t.Errorf("unexpected metadata %+v", metadata)
+	}
+}
+
+func TestParseFFprobeOutputRequiresVideo(t *testing.T) {
+	output := []byte(`{"streams": [{"codec_name": "mp3", "codec_type": "audio"}], "format": {"duration": "3.0"}}`)
+
+	_, err := parseFFprobeOutput(output)
+	if err == nil {
+		t.Error("expected an error for a file without video stream")
+	}
+}
+
+func TestPosterFilename(t *testing.T) {
+	if poster := posterFilename("0123456789abcdef0123456789abcdef.mp4"); poster != "0123456789abcdef0123456789abcdef.poster.jpg" {
+		t.Errorf("unexpected poster filename %s", poster)
+	}
+}
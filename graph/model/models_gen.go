@@ -8,6 +8,22 @@ import (
 	"strconv"
 )
 
+// An image that process mode failed to index.
+type DeadLetter struct {
+	// The source and post ID of the image, e.g. "gelbooru:1234".
+	ID string `json:"ID"`
+	// Why the last attempt failed.
+	Reason string `json:"Reason"`
+	// Number of failed attempts to index the image.
+	Attempts int `json:"Attempts"`
+	// UNIX-Timestamp of the last failed attempt.
+	Timestamp    string `json:"Timestamp"`
+	SourceName   string `json:"SourceName"`
+	SourcePostID string `json:"SourcePostID"`
+	Filename     string `json:"Filename"`
+	FileURL      string `json:"FileUrl"`
+}
+
 // A full image with all available metadata.
 type Image struct {
 	ID           string   `json:"ID"`
@@ -24,24 +40,65 @@ type Image struct {
 	Width    int    `json:"Width"`
 	Height   int    `json:"Height"`
 	Filename string `json:"Filename"`
-	// Images that are similar to this one, based on perception-hashing. By default a distance of 10 is considered related.
+	// MIME type detected from the content of the file, e.g. "image/webp". Empty for images indexed before it was detected.
+	MimeType string `json:"MimeType"`
+	// Duration of a video in seconds, 0 for images.
+	Duration float64 `json:"Duration"`
+	// Codec of a video, e.g. "h264". Empty for images.
+	VideoCodec string `json:"VideoCodec"`
+	// Whether a video has an audio track.
+	HasAudio bool `json:"HasAudio"`
+	// Name of the source the image was scraped from, e.g. "gelbooru". Empty for imported images.
+	SourceName string `json:"SourceName"`
+	// ID of the post on the source.
+	SourcePostID string `json:"SourcePostID"`
+	// Link to the post on the source.
+	SourceURL string `json:"SourceUrl"`
+	// Where the image was originally posted, usually the artist's page, as listed on the source.
+	ArtworkSource string `json:"ArtworkSource"`
+	// Score of the post on the source at the time of scraping.
+	Score int `json:"Score"`
+	// UNIX-Timestamp of when the post was uploaded to the source, empty if unknown.
+	Uploaded string `json:"Uploaded"`
+	// ID of the parent post on the source, empty if it has none.
+	ParentID string `json:"ParentID"`
+	// ID of the variant group of the image, the ID of the image itself if no similar images are known.
+	GroupID string `json:"GroupID"`
+	// Images in the same variant group as this one, based on perception-hashing.
+	// Images are grouped if their PHashes differ in at most 9 bits by default, directly or through other images of the group.
 	Related []*NestedImage `json:"Related"`
+	// Images whose PHash differs from the one of this image in at most maxDistance bits, closest first.
+	// maxDistance defaults to the distance images are grouped by and must be 0 <= maxDistance <= 16.
+	// At most 100 images are returned.
+	Similar []*SimilarImage `json:"Similar"`
 }
 
 // An image that is nested in some way. This does not contain the Related field, but is otherwise identical to Image.
 type NestedImage struct {
-	ID           string   `json:"ID"`
-	URL          string   `json:"Url"`
-	ThumbnailURL string   `json:"ThumbnailUrl"`
-	Tags         []string `json:"Tags"`
-	Tagstring    string   `json:"Tagstring"`
-	Rating       Rating   `json:"Rating"`
-	Added        string   `json:"Added"`
-	PHash        string   `json:"PHash"`
-	Size         int      `json:"Size"`
-	Width        int      `json:"Width"`
-	Height       int      `json:"Height"`
-	Filename     string   `json:"Filename"`
+	ID            string   `json:"ID"`
+	URL           string   `json:"Url"`
+	ThumbnailURL  string   `json:"ThumbnailUrl"`
+	Tags          []string `json:"Tags"`
+	Tagstring     string   `json:"Tagstring"`
+	Rating        Rating   `json:"Rating"`
+	Added         string   `json:"Added"`
+	PHash         string   `json:"PHash"`
+	Size          int      `json:"Size"`
+	Width         int      `json:"Width"`
+	Height        int      `json:"Height"`
+	Filename      string   `json:"Filename"`
+	MimeType      string   `json:"MimeType"`
+	Duration      float64  `json:"Duration"`
+	VideoCodec    string   `json:"VideoCodec"`
+	HasAudio      bool     `json:"HasAudio"`
+	SourceName    string   `json:"SourceName"`
+	SourcePostID  string   `json:"SourcePostID"`
+	SourceURL     string   `json:"SourceUrl"`
+	ArtworkSource string   `json:"ArtworkSource"`
+	Score         int      `json:"Score"`
+	Uploaded      string   `json:"Uploaded"`
+	ParentID      string   `json:"ParentID"`
+	GroupID       string   `json:"GroupID"`
 }
 
 type ServerStats struct {
@@ -55,6 +112,28 @@ type ServerStats struct {
 	Uptime string `json:"Uptime"`
 }
 
+// An image that is similar to another one.
+type SimilarImage struct {
+	// Hamming distance between the PHashes of both images, 0 means they look identical.
+	Distance int          `json:"Distance"`
+	Image    *NestedImage `json:"Image"`
+}
+
+// A scrape query that the scheduler runs periodically.
+type TagSubscription struct {
+	ID string `json:"ID"`
+	// The scrape query, in the same format as the lines read by scrape mode, e.g. "danbooru:hug max_pages=2".
+	Query string `json:"Query"`
+	// Interval between runs in seconds.
+	Interval int `json:"Interval"`
+	// UNIX-Timestamp of the last run, 0 if it never ran.
+	LastRun string `json:"LastRun"`
+	// UNIX-Timestamp of when the next run is due.
+	NextRun string `json:"NextRun"`
+	// The error of the last run, empty if it succeeded.
+	LastError string `json:"LastError"`
+}
+
 // The safety rating.
 // General is SFW, Safe is SFW but may contain some adult content, and questionable up should be considered NSFW.
 type Rating string
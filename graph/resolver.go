@@ -1,7 +1,15 @@
 package graph
 
+import "context"
+
 // This file will not be regenerated automatically.
 //
 // It serves as dependency injection for your app, add any dependencies you require here.
 
 type Resolver struct{}
+
+// isAdmin reports whether the request was authenticated with the admin token by graphqlAuthMiddleware
+func isAdmin(ctx context.Context) bool {
+	admin, ok := ctx.Value("admin").(bool)
+	return ok && admin
+}
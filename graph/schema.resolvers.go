@@ -9,9 +9,9 @@ import (
 	"Paktum/graph/model"
 	"context"
 	"fmt"
+	"strconv"
 
 	sentry "github.com/getsentry/sentry-go"
-	"github.com/jinzhu/copier"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -26,19 +26,14 @@ func (r *imageResolver) Related(ctx context.Context, obj *model.Image) ([]*model
 	relatedImages := make([]*model.NestedImage, 0)
 
 	log.Println("Fetching related images for image with ID ", obj.ID)
-	related, err := Database.GetRelatedImages(obj.ID)
+	related, err := Database.GetRelatedImages(obj.ID, obj.GroupID)
 	if err != nil {
 		sentry.CaptureException(err)
 		return nil, err
 	}
 
 	for _, relatedImage := range related {
-		var convertedImage model.NestedImage
-		err := copier.Copy(&convertedImage, &relatedImage)
-		if err != nil {
-			return nil, err
-		}
-		relatedImages = append(relatedImages, &convertedImage)
+		relatedImages = append(relatedImages, Database.DBImageToNestedImage(relatedImage))
 	}
 
 	sentry.AddBreadcrumb(&sentry.Breadcrumb{
@@ -51,6 +46,143 @@ func (r *imageResolver) Related(ctx context.Context, obj *model.Image) ([]*model
 	return relatedImages, nil
 }
 
+// Similar is the resolver for the Similar field.
+func (r *imageResolver) Similar(ctx context.Context, obj *model.Image, maxDistance *int) ([]*model.SimilarImage, error) {
+	sentry.AddBreadcrumb(&sentry.Breadcrumb{
+		Category: "graphql",
+		Message:  "Querying similar images",
+		Level:    sentry.LevelInfo,
+		Data:     map[string]interface{}{"image": obj, "maxDistance": maxDistance},
+	})
+	similarImages := make([]*model.SimilarImage, 0)
+
+	distance := Database.GetVariantMaxDistance()
+	if maxDistance != nil {
+		distance = *maxDistance
+	}
+	hash, err := strconv.ParseUint(obj.PHash, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	similar, err := Database.GetSimilarImages(obj.ID, hash, distance)
+	if err != nil {
+		sentry.CaptureException(err)
+		return nil, err
+	}
+
+	for _, similarImage := range similar {
+		similarImages = append(similarImages, &model.SimilarImage{
+			Distance: similarImage.Distance,
+			Image:    Database.DBImageToNestedImage(similarImage.Image),
+		})
+	}
+
+	return similarImages, nil
+}
+
+// AddTagSubscription is the resolver for the addTagSubscription field.
+func (r *mutationResolver) AddTagSubscription(ctx context.Context, query string, interval int) (*model.TagSubscription, error) {
+	if !isAdmin(ctx) {
+		return nil, fmt.Errorf("unauthorized")
+	}
+	sentry.AddBreadcrumb(&sentry.Breadcrumb{
+		Category: "graphql",
+		Message:  "Adding tag subscription " + query,
+		Level:    sentry.LevelInfo,
+		Data:     map[string]interface{}{"query": query, "interval": interval},
+	})
+
+	subscription, err := Database.CreateTagSubscription(query, interval)
+	if err != nil {
+		return nil, err
+	}
+
+	return Database.DBSubscriptionToGraphSubscription(subscription), nil
+}
+
+// UpdateTagSubscription is the resolver for the updateTagSubscription field.
+func (r *mutationResolver) UpdateTagSubscription(ctx context.Context, id string, query string, interval int) (*model.TagSubscription, error) {
+	if !isAdmin(ctx) {
+		return nil, fmt.Errorf("unauthorized")
+	}
+	sentry.AddBreadcrumb(&sentry.Breadcrumb{
+		Category: "graphql",
+		Message:  "Updating tag subscription " + id,
+		Level:    sentry.LevelInfo,
+		Data:     map[string]interface{}{"id": id, "query": query, "interval": interval},
+	})
+
+	subscription, err := Database.UpdateTagSubscription(id, query, interval)
+	if err != nil {
+		return nil, err
+	}
+
+	return Database.DBSubscriptionToGraphSubscription(subscription), nil
+}
+
+// RemoveTagSubscription is the resolver for the removeTagSubscription field.
+func (r *mutationResolver) RemoveTagSubscription(ctx context.Context, id string) (bool, error) {
+	if !isAdmin(ctx) {
+		return false, fmt.Errorf("unauthorized")
+	}
+	sentry.AddBreadcrumb(&sentry.Breadcrumb{
+		Category: "graphql",
+		Message:  "Removing tag subscription " + id,
+		Level:    sentry.LevelInfo,
+	})
+
+	removed, err := Database.RemoveTagSubscription(id)
+	if err != nil {
+		sentry.CaptureException(err)
+		return false, err
+	}
+
+	return removed, nil
+}
+
+// RetryDeadLetters is the resolver for the retryDeadLetters field.
+func (r *mutationResolver) RetryDeadLetters(ctx context.Context, ids []string) (int, error) {
+	if !isAdmin(ctx) {
+		return 0, fmt.Errorf("unauthorized")
+	}
+	sentry.AddBreadcrumb(&sentry.Breadcrumb{
+		Category: "graphql",
+		Message:  "Retrying dead letters",
+		Level:    sentry.LevelInfo,
+		Data:     map[string]interface{}{"ids": ids},
+	})
+
+	retried, err := Database.RetryDeadLetters(ids)
+	if err != nil {
+		sentry.CaptureException(err)
+		return retried, err
+	}
+
+	return retried, nil
+}
+
+// PurgeDeadLetters is the resolver for the purgeDeadLetters field.
+func (r *mutationResolver) PurgeDeadLetters(ctx context.Context, ids []string) (int, error) {
+	if !isAdmin(ctx) {
+		return 0, fmt.Errorf("unauthorized")
+	}
+	sentry.AddBreadcrumb(&sentry.Breadcrumb{
+		Category: "graphql",
+		Message:  "Purging dead letters",
+		Level:    sentry.LevelInfo,
+		Data:     map[string]interface{}{"ids": ids},
+	})
+
+	purged, err := Database.PurgeDeadLetters(ids)
+	if err != nil {
+		sentry.CaptureException(err)
+		return purged, err
+	}
+
+	return purged, nil
+}
+
 // Image is the resolver for the image field.
 func (r *queryResolver) Image(ctx context.Context, id string) (*model.Image, error) {
 	sentry.AddBreadcrumb(&sentry.Breadcrumb{
@@ -87,13 +219,13 @@ func (r *queryResolver) RandomImage(ctx context.Context) (*model.Image, error) {
 }
 
 // SearchImages is the resolver for the searchImages field.
-func (r *queryResolver) SearchImages(ctx context.Context, query string, limit int, shuffle *bool, rating *model.Rating) ([]*model.Image, error) {
+func (r *queryResolver) SearchImages(ctx context.Context, query string, limit int, shuffle *bool, rating *model.Rating, collapseVariants *bool) ([]*model.Image, error) {
 	log.Info("Querying images with query ", query)
 	sentry.AddBreadcrumb(&sentry.Breadcrumb{
 		Category: "graphql",
 		Message:  "Querying images with query " + query,
 		Level:    sentry.LevelInfo,
-		Data:     map[string]interface{}{"query": query, "limit": limit, "shuffle": shuffle, "rating": rating},
+		Data:     map[string]interface{}{"query": query, "limit": limit, "shuffle": shuffle, "rating": rating, "collapseVariants": collapseVariants},
 	})
 
 	if shuffle == nil {
@@ -117,7 +249,7 @@ func (r *queryResolver) SearchImages(ctx context.Context, query string, limit in
 		ratingString = ""
 	}
 
-	images, _, err := Database.SearchImages(query, limit, *shuffle, ratingString)
+	images, _, err := Database.SearchImages(query, limit, *shuffle, ratingString, collapseVariants != nil && *collapseVariants)
 	if err != nil {
 		sentry.CaptureException(err)
 		return nil, err
@@ -125,14 +257,7 @@ func (r *queryResolver) SearchImages(ctx context.Context, query string, limit in
 
 	var convertedImages []*model.Image
 	for _, image := range images {
-		var convertedImage model.Image
-		err := copier.Copy(&convertedImage, &image)
-		if err != nil {
-			sentry.CaptureException(err)
-			return nil, err
-		}
-
-		convertedImages = append(convertedImages, &convertedImage)
+		convertedImages = append(convertedImages, Database.DBImageToGraphImage(image))
 	}
 	sentry.AddBreadcrumb(&sentry.Breadcrumb{
 		Category: "graphql",
@@ -176,12 +301,12 @@ func (r *queryResolver) ServerStats(ctx context.Context) (*model.ServerStats, er
 }
 
 // PaginatedSearch is the resolver for the paginatedSearch field.
-func (r *queryResolver) PaginatedSearch(ctx context.Context, query string, limit int, page int, rating *model.Rating) ([]*model.Image, error) {
+func (r *queryResolver) PaginatedSearch(ctx context.Context, query string, limit int, page int, rating *model.Rating, collapseVariants *bool) ([]*model.Image, error) {
 	sentry.AddBreadcrumb(&sentry.Breadcrumb{
 		Category: "graphql",
 		Message:  "Querying paginated images with query " + query,
 		Level:    sentry.LevelInfo,
-		Data:     map[string]interface{}{"query": query, "limit": limit, "page": page, "rating": rating},
+		Data:     map[string]interface{}{"query": query, "limit": limit, "page": page, "rating": rating, "collapseVariants": collapseVariants},
 	})
 
 	if limit == 0 || limit > 100 {
@@ -209,7 +334,7 @@ func (r *queryResolver) PaginatedSearch(ctx context.Context, query string, limit
 		ratingString = ""
 	}
 
-	paginatedResults, _, err := Database.SearchImagesPaginated(query, limit, page, ratingString)
+	paginatedResults, _, err := Database.SearchImagesPaginated(query, limit, page, ratingString, collapseVariants != nil && *collapseVariants)
 	if err != nil {
 		sentry.CaptureException(err)
 		return nil, err
@@ -217,24 +342,61 @@ func (r *queryResolver) PaginatedSearch(ctx context.Context, query string, limit
 
 	var convertedImages []*model.Image
 	for _, image := range paginatedResults {
-		var convertedImage model.Image
-		err := copier.Copy(&convertedImage, &image)
-		if err != nil {
-			sentry.CaptureException(err)
-			return nil, err
-		}
-
-		convertedImages = append(convertedImages, &convertedImage)
+		convertedImages = append(convertedImages, Database.DBImageToGraphImage(image))
 	}
 
 	return convertedImages, nil
 }
 
+// TagSubscriptions is the resolver for the tagSubscriptions field.
+func (r *queryResolver) TagSubscriptions(ctx context.Context) ([]*model.TagSubscription, error) {
+	if !isAdmin(ctx) {
+		return nil, fmt.Errorf("unauthorized")
+	}
+
+	subscriptions, err := Database.GetTagSubscriptions()
+	if err != nil {
+		sentry.CaptureException(err)
+		return nil, err
+	}
+
+	convertedSubscriptions := make([]*model.TagSubscription, 0, len(subscriptions))
+	for _, subscription := range subscriptions {
+		convertedSubscriptions = append(convertedSubscriptions, Database.DBSubscriptionToGraphSubscription(subscription))
+	}
+
+	return convertedSubscriptions, nil
+}
+
+// DeadLetters is the resolver for the deadLetters field.
+func (r *queryResolver) DeadLetters(ctx context.Context) ([]*model.DeadLetter, error) {
+	if !isAdmin(ctx) {
+		return nil, fmt.Errorf("unauthorized")
+	}
+
+	deadLetters, err := Database.GetDeadLetters()
+	if err != nil {
+		sentry.CaptureException(err)
+		return nil, err
+	}
+
+	convertedDeadLetters := make([]*model.DeadLetter, 0, len(deadLetters))
+	for _, deadLetter := range deadLetters {
+		convertedDeadLetters = append(convertedDeadLetters, Database.DBDeadLetterToGraphDeadLetter(deadLetter))
+	}
+
+	return convertedDeadLetters, nil
+}
+
 // Image returns generated.ImageResolver implementation.
 func (r *Resolver) Image() generated.ImageResolver { return &imageResolver{r} }
 
+// Mutation returns generated.MutationResolver implementation.
+func (r *Resolver) Mutation() generated.MutationResolver { return &mutationResolver{r} }
+
 // Query returns generated.QueryResolver implementation.
 func (r *Resolver) Query() generated.QueryResolver { return &queryResolver{r} }
 
 type imageResolver struct{ *Resolver }
+type mutationResolver struct{ *Resolver }
 type queryResolver struct{ *Resolver }
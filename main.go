@@ -2,20 +2,18 @@ package main
 
 import (
 	"Paktum/Database"
-	"bytes"
+	"Paktum/ImageScraper"
+	"context"
 	"flag"
 	"fmt"
 	"github.com/getsentry/sentry-go"
 	env_flag "github.com/jnovack/flag"
 	"github.com/meilisearch/meilisearch-go"
 	log "github.com/sirupsen/logrus"
-	"io"
-	"net/http"
 	"os"
-	"os/exec"
 	"os/signal"
+	"runtime"
 	"runtime/pprof"
-	"strings"
 	"syscall"
 	"time"
 )
@@ -44,7 +42,7 @@ func main() {
 	}
 
 	var mode string
-	env_flag.StringVar(&mode, "mode", "", "The mode to run in. Either 'scrape', 'process', 'cleanup', 'inference' or 'server'")
+	env_flag.StringVar(&mode, "mode", "", "The mode to run in. Either 'scrape', 'scheduler', 'process', 'cleanup', 'import', 'deadletter', 'inference', 'server' or 'all'")
 
 	var enableCors bool
 	env_flag.BoolVar(&enableCors, "enable-cors", false, "Enable CORS headers, restricting API access to your set base URL")
@@ -67,15 +65,73 @@ func main() {
 	var redisPass string
 	env_flag.StringVar(&redisPass, "redisPass", "", "The password for the redis server")
 
+	// the queue carries image batches from scrape and scheduler mode to process mode
+	var queueBackend string
+	env_flag.StringVar(&queueBackend, "queue", "", "The queue backend, either 'redis' or 'memory'. Defaults to 'memory' in all mode and 'redis' otherwise")
+	var laneWeights string
+	env_flag.StringVar(&laneWeights, "lane-weights", "interactive=6,subscription=3,backfill=1", "The share of batches process mode claims from each priority lane")
+	var scrapeLane string
+	env_flag.StringVar(&scrapeLane, "scrape-lane", "backfill", "The priority lane scrape mode queues into for queries that don't set one")
+
 	// meili is shared by server and process mode and used as search index
 	var meiliHostname string
 	env_flag.StringVar(&meiliHostname, "meilihost", "http://localhost:7700", "The meilisearch server to connect to")
 	var meiliKey string
 	env_flag.StringVar(&meiliKey, "meilikey", "", "The meilisearch master-key to use")
 
+	// scrape mode source credentials
+	var danbooruLogin string
+	env_flag.StringVar(&danbooruLogin, "danbooru-login", "", "The Danbooru username to authenticate the scraper with (optional)")
+	var danbooruAPIKey string
+	env_flag.StringVar(&danbooruAPIKey, "danbooru-api-key", "", "The Danbooru API key to authenticate the scraper with (optional)")
+
+	// scrape and scheduler mode throttle their requests
+	var scrapeWorkers int
+	env_flag.IntVar(&scrapeWorkers, "scrape-workers", 4, "The number of tag queries scraped at once")
+	var scrapeRate int
+	env_flag.IntVar(&scrapeRate, "scrape-rate", 2, "The maximum number of requests per second sent to each scraped site")
+
+	// scheduler mode runs the tag subscriptions
+	var schedulerJitter int
+	env_flag.IntVar(&schedulerJitter, "scheduler-jitter", 60, "The maximum random delay in seconds added to each subscription run")
+
 	// process mode is used to process the images
 	var imageDir string
 	env_flag.StringVar(&imageDir, "imageDir", "./images/", "The directory to store images in")
+	var downloadWorkers int
+	env_flag.IntVar(&downloadWorkers, "download-workers", 8, "The number of images process mode downloads at once")
+	var hashWorkers int
+	env_flag.IntVar(&hashWorkers, "hash-workers", runtime.NumCPU(), "The number of images process mode decodes and hashes at once")
+	var ffmpegPath string
+	env_flag.StringVar(&ffmpegPath, "ffmpeg-path", "ffmpeg", "The ffmpeg binary used to extract poster frames of videos")
+	var ffprobePath string
+	env_flag.StringVar(&ffprobePath, "ffprobe-path", "ffprobe", "The ffprobe binary used to read the metadata of videos")
+	var maxFileSize int
+	env_flag.IntVar(&maxFileSize, "max-file-size", DefaultMaxFileSize/1024/1024, "The largest file in MiB that process mode downloads, 0 disables the limit")
+	var decodeMemory int
+	env_flag.IntVar(&decodeMemory, "decode-memory", 1024, "The approximate memory in MiB that decoded images may take up at once, 0 disables the limit")
+
+	// import mode indexes images that are already on disk
+	var importDir string
+	env_flag.StringVar(&importDir, "import-dir", "", "The directory to import images from in import mode")
+	var importRating string
+	env_flag.StringVar(&importRating, "import-rating", "questionable", "The rating for imported images whose sidecar doesn't specify one")
+	var importHardlink bool
+	env_flag.BoolVar(&importHardlink, "import-hardlink", false, "Hard-link imported images into the image directory instead of copying them")
+
+	// images whose pHashes differ in at most this many bits are grouped as variants
+	var variantDistance int
+	env_flag.IntVar(&variantDistance, "variant-distance", 9, "The largest Hamming distance between the pHashes of two images that are grouped as variants")
+
+	// all mode runs cleanup periodically
+	var cleanupInterval int
+	env_flag.IntVar(&cleanupInterval, "cleanup-interval", 3600, "The interval in seconds between cleanup runs in all mode")
+
+	// deadletter mode manages the images process mode failed to index
+	var deadLetterAction string
+	env_flag.StringVar(&deadLetterAction, "deadletter-action", "list", "The dead letter action to run in deadletter mode. Either 'list', 'retry' or 'purge'")
+	var deadLetterIDs string
+	env_flag.StringVar(&deadLetterIDs, "deadletter-ids", "", "Comma separated IDs of the dead letters to retry or purge, all of them if empty")
 
 	// server mode
 	var port int
@@ -87,10 +143,27 @@ func main() {
 		log.Warning("No admin token set, access to administrative features will be disabled")
 	}
 
+	var shutdownTimeout int
+	env_flag.IntVar(&shutdownTimeout, "shutdown-timeout", 30, "The time in seconds the server waits for in-flight requests on shutdown")
+
 	var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
 
 	env_flag.Parse()
 
+	// process, server and all mode shut down gracefully on SIGINT/SIGTERM, a second signal exits right away
+	ctx := context.Background()
+	gracefulShutdown := mode == "process" || mode == "server" || mode == "all"
+	if gracefulShutdown {
+		var stop context.CancelFunc
+		ctx, stop = signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		go func() {
+			<-ctx.Done()
+			log.Info("Shutting down gracefully, send the signal again to exit immediately")
+			stop()
+		}()
+	}
+
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
 		if err != nil {
@@ -102,22 +175,28 @@ func main() {
 			log.Error("Failed to start CPU profile:", err)
 		}
 
-		// Hook the SIGINT (CTRL+C) event to write profile on exit
-		c := make(chan os.Signal, 2)
-		signal.Notify(c, os.Interrupt, syscall.SIGTERM) // subscribe to system signals
-		onKill := func(c chan os.Signal) {
-			select {
-			case <-c:
-				defer os.Exit(0)
-				defer f.Close()
-				defer pprof.StopCPUProfile()
+		if gracefulShutdown {
+			// the mode returns on SIGINT/SIGTERM, so the profile is written on the way out
+			defer f.Close()
+			defer pprof.StopCPUProfile()
+		} else {
+			// Hook the SIGINT (CTRL+C) event to write profile on exit
+			c := make(chan os.Signal, 2)
+			signal.Notify(c, os.Interrupt, syscall.SIGTERM) // subscribe to system signals
+			onKill := func(c chan os.Signal) {
+				select {
+				case <-c:
+					defer os.Exit(0)
+					defer f.Close()
+					defer pprof.StopCPUProfile()
+				}
 			}
-		}
 
-		go onKill(c)
+			go onKill(c)
+		}
 	}
 
-	if mode != "scrape" && mode != "server" && mode != "process" && mode != "cleanup" {
+	if mode != "scrape" && mode != "server" && mode != "process" && mode != "cleanup" && mode != "import" && mode != "scheduler" && mode != "deadletter" && mode != "all" {
 		log.Error("Please choose either scraping or server mode")
 		flag.Usage()
 		os.Exit(1)
@@ -126,11 +205,62 @@ func main() {
 
 	Database.ConnectRedis(redisHostname, redisPass, 0)
 	Database.ConnectMeilisearch(meiliHostname, meiliKey)
+	if queueBackend == "" {
+		queueBackend = "redis"
+		if mode == "all" {
+			queueBackend = "memory"
+		}
+	}
+	if queueBackend == "memory" {
+		if mode != "all" {
+			log.Warning("The memory queue is only shared within this process, other modes won't see its batches")
+		}
+		Database.SetWorkQueue(Database.NewMemoryWorkQueue())
+	} else if queueBackend == "redis" {
+		Database.SetWorkQueue(Database.RedisWorkQueue{})
+	} else {
+		log.Fatal("Unknown queue backend ", queueBackend, ", choose either 'redis' or 'memory'")
+	}
+	err = Database.SetLaneWeights(laneWeights)
+	if err != nil {
+		log.Fatal("Invalid lane weights: ", err)
+	}
+	if !Database.IsLane(scrapeLane) {
+		log.Fatal("Unknown scrape lane ", scrapeLane)
+	}
+	err = Database.SetVariantMaxDistance(variantDistance)
+	if err != nil {
+		log.Fatal("Invalid variant distance: ", err)
+	}
 	Database.SetBaseURL(serverBaseURL)
 	Database.SetImgproxyBaseUrl(imgproxyBaseURL)
 	Database.SetImgproxySecrets(imgproxyKey, imgproxySalt)
 	Database.SetCorsEnabled(enableCors)
 	Database.SetAdminToken(adminToken)
+	ImageScraper.SetDanbooruCredentials(danbooruLogin, danbooruAPIKey)
+	ImageScraper.SetContext(ctx)
+	SetVideoTools(ffmpegPath, ffprobePath)
+	if scrapeRate > 0 {
+		ImageScraper.SetDefaultRateLimit(time.Second/time.Duration(scrapeRate), scrapeRate)
+	}
+	if scrapeWorkers < 1 {
+		scrapeWorkers = 1
+	}
+	if downloadWorkers < 1 {
+		downloadWorkers = 1
+	}
+	if hashWorkers < 1 {
+		hashWorkers = 1
+	}
+	processOptions := ProcessOptions{
+		DownloadWorkers: downloadWorkers,
+		HashWorkers:     hashWorkers,
+		DecodeMemory:    int64(decodeMemory) * 1024 * 1024,
+		MaxFileSize:     int64(maxFileSize) * 1024 * 1024,
+	}
+	if cleanupInterval < 1 {
+		cleanupInterval = 3600
+	}
 
 	func() { // Sentry harness to catch any panic that propagates to the top level
 		defer func() {
@@ -143,13 +273,24 @@ func main() {
 		}()
 
 		if mode == "scrape" {
-			ScrapeMode()
+			ScrapeMode(scrapeWorkers, scrapeLane)
+		} else if mode == "scheduler" {
+			SchedulerMode(ctx, time.Duration(schedulerJitter)*time.Second, scrapeWorkers)
 		} else if mode == "process" {
-			ProcessMode(imageDir)
+			ProcessMode(ctx, imageDir, processOptions)
 		} else if mode == "cleanup" {
-			CleanupMode(imageDir)
+			err := CleanupMode(imageDir)
+			if err != nil {
+				log.Fatal("Cleanup failed: ", err)
+			}
+		} else if mode == "import" {
+			ImportMode(importDir, imageDir, importRating, importHardlink, processOptions)
+		} else if mode == "deadletter" {
+			DeadLetterMode(deadLetterAction, parseDeadLetterIDs(deadLetterIDs))
 		} else if mode == "server" {
-			ServerMode(imageDir)
+			ServerMode(ctx, imageDir, time.Duration(shutdownTimeout)*time.Second)
+		} else if mode == "all" {
+			AllMode(ctx, imageDir, processOptions, time.Duration(shutdownTimeout)*time.Second, time.Duration(schedulerJitter)*time.Second, scrapeWorkers, scrapeLane, time.Duration(cleanupInterval)*time.Second)
 		} else {
 			log.Error("Please choose a valid server operation mode")
 			flag.Usage()
@@ -177,101 +318,14 @@ func imageExists(meiliIndex *meilisearch.Index, md5 string) bool {
 	return false
 }
 
-// download image
-// returns the pHash as uint64
-// and the size in bytes as int
-// and the image dimensions, width and height as int
-func downloadImage(url string, imageDir string, filename string) (error, uint64, int, int, int) {
-	temporaryImageFile, err := os.CreateTemp(imageDir, "temp-paktum-")
+// hashImageFile computes the pHash and dimensions of a downloaded image within budget
+func hashImageFile(imageDir string, filename string, budget *DecodeBudget) (error, uint64, int, int) {
+	file, err := os.Open(imageDir + filename)
 	if err != nil {
-		log.Error("Failed to create file:", err.Error())
-		return err, 0, 0, 0, 0
-	}
-
-	resp, err := http.Get(url)
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-
-		if err != nil {
-			sentry.CaptureException(err)
-			log.Error("Failed to close body:", err.Error())
-		}
-	}(resp.Body)
-	if err != nil {
-		log.Error("Failed to download image:", err.Error())
-		return err, 0, 0, 0, 0
-	}
-	log.Trace("CONTENT-LENGTH:", resp.ContentLength)
-	if resp.ContentLength < 1 {
-		log.Error("EMPTY RESPONSE, url: ", url)
-		return err, 0, 0, 0, 0
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		log.Error("Failed to download image, response code: ", resp.Status, " on url: ", url)
-		return err, 0, 0, 0, 0
-	}
-
-	var buffer bytes.Buffer
-	responseBytes, _ := io.ReadAll(resp.Body)
-	written, err := buffer.Write(responseBytes)
-	if err != nil {
-		log.Error("Failed to copy image to buffer:", err.Error())
-		return err, 0, 0, 0, 0
-	}
-	reader := bytes.NewReader(buffer.Bytes())
-	log.Trace("Written bytes to buffer:", written)
-
-	size := int(resp.ContentLength)
-
-	imgByteCount, err := io.Copy(temporaryImageFile, reader)
-	reader.Seek(0, 0)
-	if err != nil {
-		log.Error("Failed to write data into image:", err.Error())
-		return err, 0, 0, 0, 0
-	}
-	log.Trace("Downloaded image, size: ", imgByteCount, " bytes")
-
-	err = temporaryImageFile.Close()
-	if err != nil {
-		return err, 0, 0, 0, 0
-	}
-
-	// rename temp image file to proper name
-	err = os.Rename(temporaryImageFile.Name(), imageDir+filename)
-	if err != nil {
-		log.Error("Failed to move image:", err.Error())
-		return err, 0, 0, 0, 0
-	}
-
-	if strings.HasSuffix(filename, ".webm") || strings.HasSuffix(filename, ".mp4") {
-		// video files have their frame extracted by ffmpeg
-		// and the frame is used as the image
-		log.Trace("Launching ffmpeg subprocess to extract frame from video")
-		log.Info("Extracting first frame from video file ", filename)
-		cmd := exec.Command("/usr/bin/ffmpeg", "-i", imageDir+filename, "-frames:v", "1", "-s", fmt.Sprintf("%dx%d", 640, 480), "-c:v", "mjpeg", "-f", "mjpeg", "-")
-		log.Info(cmd.Path, cmd.Args)
-
-		var videoFrame bytes.Buffer
-		cmd.Stdout = &videoFrame // overwrite the main buffer with video frame
-		var stderrBuffer bytes.Buffer
-		cmd.Stderr = &stderrBuffer
-		err = cmd.Run()
-
-		if err != nil {
-			sentry.CaptureException(err)
-			log.Error("ffmpeg error: ", err, stderrBuffer.String())
-		}
-
-		reader = bytes.NewReader(videoFrame.Bytes())
-		reader.Seek(0, 0)
+		return err, 0, 0, 0
 	}
+	defer file.Close()
 
 	// calculate pHash
-	decodedImage := DecodeImage(io.NopCloser(reader))
-	if decodedImage == nil {
-		return nil, 0, size, 0, 0
-	}
-
-	return nil, GeneratePHash(decodedImage), size, decodedImage.Bounds().Dx(), decodedImage.Bounds().Dy()
+	return HashImage(file, budget)
 }